@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+)
+
+// accountDeletionPolicy decides what happens to a deleted account's
+// messages. main sets it from ARGO_ACCOUNT_DELETION.
+var accountDeletionPolicy = AccountDeletionTombstone
+
+// ***********************************************
+// deleteAccount removes the user and everything that lets them in, takes
+// them out of their conversations, scrubs their messages by policy and
+// tells the people they talked to.
+func deleteAccount(username string) error {
+	// end every session first so nothing new arrives while we clean up
+	if err := revokeUserSessions(username); err != nil {
+		return err
+	}
+	conversations, err := db.RemoveParticipant(username)
+	if err != nil {
+		return err
+	}
+	if err := db.ScrubUserMessages(username, accountDeletionPolicy); err != nil {
+		return err
+	}
+	if err := db.DeleteUser(username); err != nil {
+		return err
+	}
+	log.Println("deleted account", username, "from", len(conversations), "conversations")
+
+	for _, conversation := range conversations {
+		remaining := participantNames(conversation, "")
+		if len(remaining) == 0 {
+			continue
+		}
+		broadcast(remaining, FrameLeave, "", LeavePayload{
+			ConvID:   conversation.ID,
+			Username: username,
+			Messages: accountDeletionPolicy,
+		})
+		sendConversationUpdate(remaining, conversation.ID)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// ***********************************************
+// authorizeConversation loads a conversation on behalf of username. Every
+// REST handler and the WebSocket loop go through here before reading or
+// writing a conversation. Callers that are not participants get
+// ErrNotFound so they cannot tell a foreign conversation from a missing one.
+func authorizeConversation(username, conversationID string) (Conversation, error) {
+	if username == "" || conversationID == "" {
+		return Conversation{}, ErrNotFound
+	}
+
+	conversation, err := db.GetUserConversation(username, conversationID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if _, ok := conversation.Participants[username]; !ok {
+		return Conversation{}, ErrNotFound
+	}
+	return conversation, nil
+}
+
+// ***********************************************
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	if err == ErrNotFound {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	log.Println("conversation lookup err", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
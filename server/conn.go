@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait     = 10 * time.Second
+	pongWait      = 60 * time.Second
+	pingPeriod    = 50 * time.Second
+	sendQueueSize = 256
+)
+
+// Conn is one device's WebSocket connection. gorilla/websocket allows a
+// single concurrent writer, so a Conn owns a bounded outbound queue and
+// one writer goroutine that drains it and sends the pings. Everything
+// else, other users' read loops included, only ever calls Send.
+type Conn struct {
+	Username string
+	DeviceID string
+	// CursorDevice keys the delivery cursor. It is empty when the client
+	// did not name its device, since DeviceID is then new every time.
+	CursorDevice string
+	// Version is the protocol the client asked for when it authenticated
+	Version int
+	// SessionID is the session of the token the client authenticated with
+	SessionID string
+
+	ws        *websocket.Conn
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// while holding, live frames wait in pending so missed messages can
+	// be replayed ahead of them; replayed remembers what was already sent
+	mu       sync.Mutex
+	holding  bool
+	pending  []heldFrame
+	replayed map[string]bool
+}
+
+type heldFrame struct {
+	id   string
+	data []byte
+}
+
+// ***********************************************
+func NewConn(ws *websocket.Conn, username, deviceID string) *Conn {
+	return newConnWithQueue(ws, username, deviceID, sendQueueSize)
+}
+
+// ***********************************************
+func newConnWithQueue(ws *websocket.Conn, username, deviceID string, queueSize int) *Conn {
+	c := &Conn{
+		Username: username,
+		DeviceID: deviceID,
+		ws:       ws,
+		send:     make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+	}
+	go c.writePump()
+	return c
+}
+
+// ***********************************************
+// Send queues a text frame and never blocks. A client that lets its
+// queue fill up is too slow to keep up and gets disconnected.
+func (c *Conn) Send(data []byte) bool {
+	return c.SendMessage("", data)
+}
+
+// ***********************************************
+// SendMessage is Send for a frame carrying the message with the given id.
+// The id lets a frame that arrives during a hold be dropped if the same
+// message was already replayed.
+func (c *Conn) SendMessage(id string, data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.holding {
+		if len(c.pending) >= cap(c.send) {
+			log.Println("held queue full for", c.Username, "on device", c.DeviceID)
+			c.Close()
+			return false
+		}
+		c.pending = append(c.pending, heldFrame{id: id, data: data})
+		return true
+	}
+	return c.enqueue(data)
+}
+
+// ***********************************************
+// Hold starts buffering live frames. Replay then writes missed messages
+// straight to the queue, and Release lets the buffered frames through.
+func (c *Conn) Hold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.holding = true
+	c.replayed = make(map[string]bool)
+}
+
+// ***********************************************
+// Replay queues a missed message ahead of any held live frames. Unlike
+// Send it waits for room in the queue, since a backlog can be large.
+func (c *Conn) Replay(id string, data []byte) bool {
+	c.mu.Lock()
+	if c.replayed != nil {
+		c.replayed[id] = true
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// ***********************************************
+func (c *Conn) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, frame := range c.pending {
+		if frame.id != "" && c.replayed[frame.id] {
+			continue
+		}
+		if !c.enqueue(frame.data) {
+			break
+		}
+	}
+	c.holding = false
+	c.pending = nil
+	c.replayed = nil
+}
+
+// ***********************************************
+// enqueue pushes onto the queue without blocking. Callers hold c.mu.
+func (c *Conn) enqueue(data []byte) bool {
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	default:
+		log.Println("send queue full for", c.Username, "on device", c.DeviceID)
+		c.Close()
+		return false
+	}
+}
+
+// ***********************************************
+func (c *Conn) SendJSON(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Marshal", err)
+		return false
+	}
+	return c.Send(data)
+}
+
+// ***********************************************
+// Close flushes whatever is already queued, sends a close frame and shuts
+// the socket down. It is safe to call from any goroutine, more than once.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// ***********************************************
+// Done is closed once the connection starts shutting down.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// ***********************************************
+func (c *Conn) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		if err := c.ws.Close(); err != nil {
+			log.Println("error closing WebSocket connection", err)
+		}
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.write(websocket.TextMessage, data); err != nil {
+				log.Println("Error writing message to", c.Username, "on device", c.DeviceID, err)
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				log.Println("write ping:", err)
+				c.Close()
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// ***********************************************
+// flush writes the frames that were queued before Close was called.
+func (c *Conn) flush() {
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.write(websocket.TextMessage, data); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// ***********************************************
+func (c *Conn) write(messageType int, data []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(messageType, data)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ***********************************************
+// startConnServer runs a server that wraps every accepted socket in a
+// Conn and hands it to the test.
+func startConnServer(t *testing.T, queueSize int) (*httptest.Server, <-chan *Conn) {
+	t.Helper()
+	conns := make(chan *Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- newConnWithQueue(ws, "receiver", "device", queueSize)
+	}))
+	return server, conns
+}
+
+// ***********************************************
+// TestConnConcurrentSenders is meant to be run with -race. Many goroutines
+// send to one Conn at once, the way every other user's read loop does,
+// and a single receiver must see every frame intact.
+func TestConnConcurrentSenders(t *testing.T) {
+	const senders = 50
+	const perSender = 100
+
+	server, conns := startConnServer(t, senders*perSender)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not open a websocket connection: %v", err)
+	}
+	defer ws.Close()
+	conn := <-conns
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if !conn.Send([]byte(fmt.Sprintf("%d:%d", s, i))) {
+					t.Errorf("send %d:%d was dropped", s, i)
+					return
+				}
+			}
+		}(s)
+	}
+
+	received := make(map[string]bool, senders*perSender)
+	next := make(map[int]int, senders)
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for len(received) < senders*perSender {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %d frames: %v", len(received), err)
+		}
+		var s, i int
+		if _, err := fmt.Sscanf(string(data), "%d:%d", &s, &i); err != nil {
+			t.Fatalf("corrupted frame %q", data)
+		}
+		// each sender's frames arrive in the order it queued them
+		if i != next[s] {
+			t.Fatalf("sender %d: got frame %d want %d", s, i, next[s])
+		}
+		next[s]++
+		received[string(data)] = true
+	}
+	wg.Wait()
+
+	// closing from several goroutines at once is fine and later sends
+	// are refused instead of racing the writer
+	var closers sync.WaitGroup
+	for c := 0; c < 10; c++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			conn.Close()
+		}()
+	}
+	closers.Wait()
+	if conn.Send([]byte("late")) {
+		t.Errorf("send after close was accepted")
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected a normal close frame, got %v", err)
+	}
+}
+
+// ***********************************************
+func TestConnFlushesQueueOnClose(t *testing.T) {
+	server, conns := startConnServer(t, 8)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Could not open a websocket connection: %v", err)
+	}
+	defer ws.Close()
+	conn := <-conns
+
+	conn.SendJSON(ErrorFrame{Type: "error", Code: "bye", Message: "closing"})
+	conn.Close()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var frame ErrorFrame
+	if err := ws.ReadJSON(&frame); err != nil {
+		t.Fatalf("queued frame was lost on close: %v", err)
+	}
+	if frame.Code != "bye" {
+		t.Errorf("unexpected frame: %+v", frame)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"time"
 
+	"github.com/joemafrici/argo/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -15,6 +19,14 @@ type DBClient struct {
 	name   string
 }
 
+var _ Store = (*DBClient)(nil)
+
+// usernameCollation compares usernames ignoring case, so a legacy
+// "Alice" and a new "alice" are the same name to the unique index.
+// Everything that looks a user up by username has to use it too, or a
+// legacy mixed-case name would not be found.
+var usernameCollation = &options.Collation{Locale: "en", Strength: 2}
+
 // ***********************************************
 func NewDBClient(connectionString, dbname string) (*DBClient, error) {
 
@@ -40,46 +52,700 @@ func (db *DBClient) Close() error {
 	return db.client.Disconnect(ctx)
 }
 
+// ***********************************************
+func (db *DBClient) EnsureIndexes() error {
+	ctx := context.TODO()
+	users := db.client.Database(db.name).Collection("users")
+	_, err := users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true).SetCollation(usernameCollation),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create user indexes, check for duplicate usernames: %w", err)
+	}
+
+	conversations := db.client.Database(db.name).Collection("conversations")
+	_, err = conversations.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// conversation lists, newest first
+			Keys: bson.D{{Key: "members", Value: 1}, {Key: "lastActivity", Value: -1}, {Key: "id", Value: -1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create conversation indexes: %w", err)
+	}
+
+	messages := db.client.Database(db.name).Collection("messages")
+	_, err = messages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "convid", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "id", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create message indexes: %w", err)
+	}
+
+	cursors := db.client.Database(db.name).Collection("deliveryCursors")
+	// cursors used to be per user, and that index refuses a second device
+	if _, err := cursors.Indexes().DropOne(ctx, "username_1"); err != nil && !isIndexNotFound(err) {
+		return fmt.Errorf("Failed to drop the old delivery cursor index: %w", err)
+	}
+	_, err = cursors.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}, {Key: "device", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create delivery cursor indexes: %w", err)
+	}
+
+	sessions := db.client.Database(db.name).Collection("sessions")
+	_, err = sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create session indexes: %w", err)
+	}
+
+	refreshTokens := db.client.Database(db.name).Collection("refreshTokens")
+	_, err = refreshTokens.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "family", Value: 1}},
+		},
+		{
+			// expired tokens are useless, let MongoDB drop them
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create refresh token indexes: %w", err)
+	}
+
+	loginAttempts := db.client.Database(db.name).Collection("loginAttempts")
+	_, err = loginAttempts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create login attempt indexes: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+// Migrate brings documents written by older versions of the server up to
+// the current layout.
+func (db *DBClient) Migrate() error {
+	if err := db.MigrateEmbeddedMessages(); err != nil {
+		return err
+	}
+	if err := db.BackfillConversationActivity(); err != nil {
+		return err
+	}
+	if err := db.BackfillConversationMembers(); err != nil {
+		return err
+	}
+	return db.BackfillCursorDevices()
+}
+
+// ***********************************************
+// MigrateEmbeddedMessages moves messages that are still embedded in
+// conversation documents into the messages collection. It is safe to
+// run on every startup; conversations that were already split are skipped.
+func (db *DBClient) MigrateEmbeddedMessages() error {
+	ctx := context.TODO()
+	conversations := db.client.Database(db.name).Collection("conversations")
+	messages := db.client.Database(db.name).Collection("messages")
+
+	cursor, err := conversations.Find(ctx, bson.M{"messages": bson.M{"$exists": true}})
+	if err != nil {
+		return fmt.Errorf("Failed to find conversations to migrate: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var conversation Conversation
+		if err := cursor.Decode(&conversation); err != nil {
+			return fmt.Errorf("Failed to decode conversation: %w", err)
+		}
+
+		if len(conversation.Messages) > 0 {
+			models := make([]mongo.WriteModel, 0, len(conversation.Messages))
+			for _, message := range conversation.Messages {
+				message.ConvID = conversation.ID
+				models = append(models, mongo.NewUpdateOneModel().
+					SetFilter(bson.M{"id": message.ID}).
+					SetUpdate(bson.M{"$setOnInsert": message}).
+					SetUpsert(true))
+			}
+			_, err := messages.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			if err != nil {
+				return fmt.Errorf("Failed to copy messages of conversation %s: %w", conversation.ID, err)
+			}
+		}
+
+		_, err := conversations.UpdateOne(ctx, bson.M{"id": conversation.ID}, bson.M{"$unset": bson.M{"messages": ""}})
+		if err != nil {
+			return fmt.Errorf("Failed to remove embedded messages of conversation %s: %w", conversation.ID, err)
+		}
+		migrated++
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("Cursor error: %w", err)
+	}
+	if migrated > 0 {
+		log.Println("migrated embedded messages of", migrated, "conversations")
+	}
+	return nil
+}
+
+// ***********************************************
+// BackfillConversationActivity sets lastMessage and lastActivity on
+// conversations created before summaries existed so they sort correctly.
+func (db *DBClient) BackfillConversationActivity() error {
+	ctx := context.TODO()
+	conversations := db.client.Database(db.name).Collection("conversations")
+	messages := db.client.Database(db.name).Collection("messages")
+
+	cursor, err := conversations.Find(ctx, bson.M{"lastActivity": bson.M{"$exists": false}})
+	if err != nil {
+		return fmt.Errorf("Failed to find conversations to backfill: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var conversation Conversation
+		if err := cursor.Decode(&conversation); err != nil {
+			return fmt.Errorf("Failed to decode conversation: %w", err)
+		}
+
+		set := bson.M{"lastActivity": time.Unix(0, 0).UTC()}
+		var last Message
+		opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "id", Value: -1}})
+		err := messages.FindOne(ctx, bson.M{"convid": conversation.ID}, opts).Decode(&last)
+		if err == nil {
+			set["lastMessage"] = last.Summary()
+			if last.Timestamp != nil {
+				set["lastActivity"] = *last.Timestamp
+			}
+		} else if err != mongo.ErrNoDocuments {
+			return fmt.Errorf("Failed to find last message of conversation %s: %w", conversation.ID, err)
+		}
+
+		_, err = conversations.UpdateOne(ctx, bson.M{"id": conversation.ID}, bson.M{"$set": set})
+		if err != nil {
+			return fmt.Errorf("Failed to backfill conversation %s: %w", conversation.ID, err)
+		}
+	}
+	return cursor.Err()
+}
+
+// ***********************************************
+// BackfillConversationMembers sets members on conversations created
+// before it existed, so member lookups find them.
+func (db *DBClient) BackfillConversationMembers() error {
+	ctx := context.TODO()
+	conversations := db.client.Database(db.name).Collection("conversations")
+
+	opts := options.Find().SetProjection(bson.M{"id": 1, "participants": 1})
+	cursor, err := conversations.Find(ctx, bson.M{"members": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to find conversations to backfill: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var conversation Conversation
+		if err := cursor.Decode(&conversation); err != nil {
+			return fmt.Errorf("Failed to decode conversation: %w", err)
+		}
+		update := bson.M{"$set": bson.M{"members": conversationMembers(conversation)}}
+		_, err := conversations.UpdateOne(ctx, bson.M{"id": conversation.ID}, update)
+		if err != nil {
+			return fmt.Errorf("Failed to backfill members of conversation %s: %w", conversation.ID, err)
+		}
+	}
+	return cursor.Err()
+}
+
+// ***********************************************
+// BackfillCursorDevices gives the per-user cursors from before cursors
+// were per device to device "", which clients that do not name their
+// device share.
+func (db *DBClient) BackfillCursorDevices() error {
+	ctx := context.TODO()
+	cursors := db.client.Database(db.name).Collection("deliveryCursors")
+
+	filter := bson.M{"device": bson.M{"$exists": false}}
+	if _, err := cursors.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"device": ""}}); err != nil {
+		return fmt.Errorf("Failed to backfill delivery cursor devices: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+// conversationMembers lists the participants' usernames. MongoDB can't
+// index the keys of the participants map, but it can index this.
+func conversationMembers(conversation Conversation) []string {
+	members := make([]string, 0, len(conversation.Participants))
+	for username := range conversation.Participants {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members
+}
+
 // ***********************************************
 func (db *DBClient) CreateConversation(conversation Conversation) error {
 	ctx := context.TODO()
 	c := db.client.Database(db.name).Collection("conversations")
-	if conversation.Messages == nil {
-		conversation.Messages = []Message{}
+	// messages live in their own collection
+	conversation.Messages = nil
+	conversation.Members = conversationMembers(conversation)
+	if conversation.LastActivity == nil {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		conversation.LastActivity = &now
 	}
 	_, err := c.InsertOne(ctx, conversation)
 	if err != nil {
 		return fmt.Errorf("Error creating new conversation: %w", err)
 	}
-	return nil
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) AddMessageToConversation(message Message) error {
+	ctx := context.TODO()
+	conversations := db.client.Database(db.name).Collection("conversations")
+	messages := db.client.Database(db.name).Collection("messages")
+
+	var conversation Conversation
+	opts := options.FindOne().SetProjection(bson.M{"participants": 1})
+	err := conversations.FindOne(ctx, bson.M{"id": message.ConvID}, opts).Decode(&conversation)
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("no conversation found with id %s", message.ConvID)
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up conversation: %w", err)
+	}
+
+	_, err = messages.InsertOne(ctx, message)
+	if utils.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return fmt.Errorf("error storing message: %w", err)
+	}
+
+	// keep the summary fields and everyone else's unread count current
+	update := bson.M{
+		"$set": bson.M{"lastMessage": message.Summary()},
+	}
+	if message.Timestamp != nil {
+		update["$max"] = bson.M{"lastActivity": *message.Timestamp}
+	}
+	unread := bson.M{}
+	for username := range conversation.Participants {
+		if username != message.From {
+			unread["participants."+username+".unreadCount"] = 1
+		}
+	}
+	if len(unread) > 0 {
+		update["$inc"] = unread
+	}
+	_, err = conversations.UpdateOne(ctx, bson.M{"id": message.ConvID}, update)
+	if err != nil {
+		return fmt.Errorf("error updating conversation summary: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) MarkConversationRead(convID, username string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("conversations")
+
+	filter := bson.M{
+		"id":                       convID,
+		"participants." + username: bson.M{"$exists": true},
+	}
+	update := bson.M{
+		"$set": bson.M{"participants." + username + ".unreadCount": 0},
+	}
+	result, err := c.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error marking conversation read: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) GetConversationSummaries(username string, page SummaryPage) ([]Conversation, bool, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("conversations")
+
+	filter := bson.M{"members": username}
+	if page.Before != nil {
+		filter["$or"] = bson.A{
+			bson.M{"lastActivity": bson.M{"$lt": page.Before.Timestamp}},
+			bson.M{"lastActivity": page.Before.Timestamp, "id": bson.M{"$lt": page.Before.ID}},
+		}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "lastActivity", Value: -1}, {Key: "id", Value: -1}}).
+		SetProjection(bson.M{"messages": 0}).
+		SetLimit(int64(page.Limit + 1))
+
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to execute query: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	conversations := []Conversation{}
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return nil, false, fmt.Errorf("Failed to decode conversations: %w", err)
+	}
+	hasMore := len(conversations) > page.Limit
+	if hasMore {
+		conversations = conversations[:page.Limit]
+	}
+	return conversations, hasMore, nil
+}
+
+// ***********************************************
+func (db *DBClient) GetConversationMessages(convID string) ([]Message, error) {
+	return db.findMessages(bson.M{"convid": convID})
+}
+
+// ***********************************************
+func (db *DBClient) GetMessagePage(convID string, page MessagePage) ([]Message, bool, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	filter := bson.M{"convid": convID}
+	if page.Viewer != "" {
+		filter["hiddenFor"] = bson.M{"$ne": page.Viewer}
+	}
+	order := -1
+	if page.After != nil {
+		filter["$or"] = cursorFilter("$gt", *page.After)
+		order = 1
+	} else if page.Before != nil {
+		filter["$or"] = cursorFilter("$lt", *page.Before)
+	}
+
+	// fetch one extra message to find out whether there is another page
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: order}, {Key: "id", Value: order}}).
+		SetLimit(int64(page.Limit + 1))
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to execute query: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, fmt.Errorf("Failed to decode messages: %w", err)
+	}
+
+	hasMore := len(messages) > page.Limit
+	if hasMore {
+		messages = messages[:page.Limit]
+	}
+	if order < 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, hasMore, nil
+}
+
+// ***********************************************
+func (db *DBClient) GetMessage(id string) (Message, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	var message Message
+	err := c.FindOne(ctx, bson.M{"id": id}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return Message{}, ErrNotFound
+	}
+	return message, err
+}
+
+// ***********************************************
+func (db *DBClient) GetMessagesSince(username string, after Cursor, limit int) ([]Message, error) {
+	ctx := context.TODO()
+	conversations := db.client.Database(db.name).Collection("conversations")
+	messages := db.client.Database(db.name).Collection("messages")
+
+	filter := bson.M{"members": username}
+	ids, err := conversations.Distinct(ctx, "id", filter)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list conversations: %w", err)
+	}
+	if len(ids) == 0 {
+		return []Message{}, nil
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := messages.Find(ctx, bson.M{
+		"convid":    bson.M{"$in": ids},
+		"$or":       cursorFilter("$gt", after),
+		"hiddenFor": bson.M{"$ne": username},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute query: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	result := []Message{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, fmt.Errorf("Failed to decode messages: %w", err)
+	}
+	return result, nil
+}
+
+// ***********************************************
+func (db *DBClient) HideMessage(messageID, username string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	update := bson.M{"$addToSet": bson.M{"hiddenFor": username}}
+	result, err := c.UpdateOne(ctx, bson.M{"id": messageID}, update)
+	if err != nil {
+		return fmt.Errorf("error hiding message: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) TombstoneMessage(messageID string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	update := bson.M{
+		"$set":   bson.M{"deleted": true, "content": ""},
+		"$unset": bson.M{"revisions": ""},
+	}
+	result, err := c.UpdateOne(ctx, bson.M{"id": messageID}, update)
+	if err != nil {
+		return fmt.Errorf("error deleting message: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) EditMessage(messageID, content string, at time.Time) (Message, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	// a pipeline update sees the document as it was, so the replaced
+	// content can be pushed onto the revisions in the same write
+	revision := bson.M{
+		"content":   "$content",
+		"timestamp": bson.M{"$ifNull": bson.A{"$editedAt", "$timestamp"}},
+	}
+	revisions := bson.M{"$concatArrays": bson.A{
+		bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+		bson.A{revision},
+	}}
+	update := bson.A{bson.M{"$set": bson.M{
+		"revisions": bson.M{"$slice": bson.A{revisions, -maxRevisions}},
+		// content comes from the client, $literal keeps a "$from" from
+		// being read as a field path
+		"content":  bson.M{"$literal": content},
+		"edited":   true,
+		"editedAt": at,
+	}}}
+	filter := bson.M{"id": messageID, "deleted": bson.M{"$ne": true}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return Message{}, ErrNotFound
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("error editing message: %w", err)
+	}
+	return message, nil
+}
+
+// ***********************************************
+func (db *DBClient) RecordReceipt(messageID, username, status string, at time.Time) (bool, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("messages")
+
+	// $min sets a missing field, so the first receipt sticks and a
+	// repeated ack leaves the document unmodified
+	fields := bson.M{"receipts." + username + ".delivered": at}
+	if status == ReceiptRead {
+		fields["receipts."+username+".read"] = at
+	}
+	result, err := c.UpdateOne(ctx, bson.M{"id": messageID}, bson.M{"$min": fields})
+	if err != nil {
+		return false, fmt.Errorf("error recording receipt: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return false, ErrNotFound
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ***********************************************
+func (db *DBClient) GetDeliveryCursor(username, device string) (Cursor, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("deliveryCursors")
+
+	var stored struct {
+		Timestamp time.Time `bson:"timestamp"`
+		ID        string    `bson:"id"`
+	}
+	err := c.FindOne(ctx, bson.M{"username": username, "device": device}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return Cursor{}, ErrNotFound
+	}
+	if err != nil {
+		return Cursor{}, err
+	}
+	return Cursor{Timestamp: stored.Timestamp, ID: stored.ID}, nil
+}
+
+// ***********************************************
+// AdvanceDeliveryCursor moves the device's cursor forward to cursor. A
+// cursor behind the stored one is ignored, so late acks cannot rewind it.
+func (db *DBClient) AdvanceDeliveryCursor(username, device string, cursor Cursor) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("deliveryCursors")
+
+	filter := bson.M{
+		"username": username,
+		"device":   device,
+		"$or":      cursorFilter("$lt", cursor),
+	}
+	update := bson.M{"$set": bson.M{"timestamp": cursor.Timestamp, "id": cursor.ID}}
+	result, err := c.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("Failed to advance delivery cursor: %w", err)
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// either there is no cursor yet or it is already further ahead; the
+	// unique index on username and device makes the insert fail in the
+	// second case
+	_, err = c.InsertOne(ctx, bson.M{"username": username, "device": device, "timestamp": cursor.Timestamp, "id": cursor.ID})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("Failed to create delivery cursor: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+// isIndexNotFound reports whether dropping an index failed only because
+// the index, or its collection, does not exist.
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	// 26 is NamespaceNotFound, 27 is IndexNotFound
+	return errors.As(err, &commandErr) && (commandErr.Code == 26 || commandErr.Code == 27)
+}
+
+// ***********************************************
+func cursorFilter(op string, cursor Cursor) bson.A {
+	return bson.A{
+		bson.M{"timestamp": bson.M{op: cursor.Timestamp}},
+		bson.M{"timestamp": cursor.Timestamp, "id": bson.M{op: cursor.ID}},
+	}
 }
 
 // ***********************************************
-func (db *DBClient) AddMessageToConversation(message Message) error {
+func (db *DBClient) findMessages(filter bson.M) ([]Message, error) {
 	ctx := context.TODO()
-	coll := db.client.Database(db.name).Collection("conversations")
+	c := db.client.Database(db.name).Collection("messages")
 
-	// Find the conversation document
-	filter := bson.M{"id": message.ConvID}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "id", Value: 1}})
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute query: %w", err)
+	}
+	defer cursor.Close(ctx)
 
-	// Update the recipient's messages array
-	update := bson.M{
-		"$push": bson.M{
-			"messages": message,
-		},
+	messages := []Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, fmt.Errorf("Failed to decode messages: %w", err)
+	}
+	return messages, nil
+}
+
+// ***********************************************
+// attachMessages fills in the Messages of each conversation with a
+// single query against the messages collection.
+func (db *DBClient) attachMessages(conversations []Conversation, viewer string) error {
+	if len(conversations) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		ids = append(ids, conversation.ID)
 	}
 
-	// Perform the update operation
-	result, err := coll.UpdateOne(ctx, filter, update)
+	filter := bson.M{"convid": bson.M{"$in": ids}}
+	if viewer != "" {
+		filter["hiddenFor"] = bson.M{"$ne": viewer}
+	}
+	messages, err := db.findMessages(filter)
 	if err != nil {
-		fmt.Println(err)
-		return fmt.Errorf("error updating recipient's messages: %w", err)
+		return err
 	}
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("no conversation found with id %s", message.ConvID)
+	byConversation := make(map[string][]Message, len(conversations))
+	for _, message := range messages {
+		byConversation[message.ConvID] = append(byConversation[message.ConvID], message)
 	}
-	if result.ModifiedCount == 0 {
-		return fmt.Errorf("no updates performed on the conversation with id %s", message.ConvID)
+	for i := range conversations {
+		conversations[i].Messages = byConversation[conversations[i].ID]
+		if conversations[i].Messages == nil {
+			conversations[i].Messages = []Message{}
+		}
 	}
 	return nil
 }
@@ -88,23 +754,61 @@ func (db *DBClient) AddMessageToConversation(message Message) error {
 func (db *DBClient) GetUserConversation(username string, id string) (Conversation, error) {
 	var conversation Conversation
 	collection := db.client.Database(db.name).Collection("conversations")
-	filter := bson.M{"id": id}
+	filter := bson.M{
+		"id":                       id,
+		"participants." + username: bson.M{"$exists": true},
+	}
 	err := collection.FindOne(context.TODO(), filter).Decode(&conversation)
+	if err == mongo.ErrNoDocuments {
+		return Conversation{}, ErrNotFound
+	}
 	if err != nil {
 		return Conversation{}, err
 	}
 
+	conversation.Messages = nil
 	return conversation, nil
 }
 
 // ***********************************************
-func (db *DBClient) GetUserConversations(username string) ([]Conversation, error) {
+func (db *DBClient) GetContacts(username string) ([]string, error) {
 	ctx := context.TODO()
 	c := db.client.Database(db.name).Collection("conversations")
 
-	f := bson.M{
-		fmt.Sprintf("participants.%s", username): bson.M{"$exists": true},
+	filter := bson.M{"members": username}
+	opts := options.Find().SetProjection(bson.M{"participants": 1})
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute query: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	seen := make(map[string]bool)
+	contacts := []string{}
+	for cursor.Next(ctx) {
+		var conversation Conversation
+		if err := cursor.Decode(&conversation); err != nil {
+			return nil, fmt.Errorf("Failed to decode conversation: %w", err)
+		}
+		for participant := range conversation.Participants {
+			if participant != username && !seen[participant] {
+				seen[participant] = true
+				contacts = append(contacts, participant)
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("Cursor error: %w", err)
 	}
+	return contacts, nil
+}
+
+// ***********************************************
+func (db *DBClient) GetUserConversations(username string) ([]Conversation, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("conversations")
+
+	f := bson.M{"members": username}
 
 	cursor, err := c.Find(ctx, f)
 	if err != nil {
@@ -123,6 +827,9 @@ func (db *DBClient) GetUserConversations(username string) ([]Conversation, error
 	if err := cursor.Err(); err != nil {
 		return nil, fmt.Errorf("Corsor error: %w", err)
 	}
+	if err := db.attachMessages(conversations, username); err != nil {
+		return nil, err
+	}
 	return conversations, nil
 }
 
@@ -151,6 +858,9 @@ func (db *DBClient) GetAllConversations() ([]Conversation, error) {
 	if err := cursor.Err(); err != nil {
 		return nil, err
 	}
+	if err := db.attachMessages(conversations, ""); err != nil {
+		return nil, err
+	}
 	return conversations, nil
 }
 
@@ -184,7 +894,11 @@ func (db *DBClient) StoreUserSalt(username, salt string) error {
 		},
 	}
 
-	result, err := c.UpdateOne(ctx, f, u)
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, f, u, opts)
+	if err != nil {
+		return err
+	}
 	if result.MatchedCount == 0 {
 		log.Println("Unable to find " + username + " in database")
 	} else {
@@ -205,7 +919,11 @@ func (db *DBClient) StoreUserKeys(username, publicKey, encryptedPrivateKey strin
 		},
 	}
 
-	result, err := c.UpdateOne(ctx, f, u)
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, f, u, opts)
+	if err != nil {
+		return err
+	}
 	if result.MatchedCount == 0 {
 		log.Println("Unable to find " + username + " in database")
 	} else {
@@ -214,11 +932,176 @@ func (db *DBClient) StoreUserKeys(username, publicKey, encryptedPrivateKey strin
 	return err
 }
 
+// ***********************************************
+func (db *DBClient) ChangePassword(username, oldHash, newHash, encryptedPrivateKey, saltBase64 string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("users")
+
+	filter := bson.M{"username": username, "password": oldHash}
+	update := bson.M{
+		"$set": bson.M{
+			"password":            newHash,
+			"encryptedPrivateKey": encryptedPrivateKey,
+			"saltBase64":          saltBase64,
+		},
+	}
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("error changing password: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) CreateSession(session Session) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	_, err := c.InsertOne(ctx, session)
+	return err
+}
+
+// ***********************************************
+func (db *DBClient) GetSession(id string) (Session, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	var session Session
+	err := c.FindOne(ctx, bson.M{"id": id}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+// ***********************************************
+func (db *DBClient) GetUserSessions(username string) ([]Session, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	filter := bson.M{"username": username, "revokedAt": bson.M{"$exists": false}}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error finding sessions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	sessions := make([]Session, 0)
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, fmt.Errorf("error decoding sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// ***********************************************
+func (db *DBClient) TouchSession(id string, at time.Time) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	result, err := c.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$max": bson.M{"lastSeen": at}})
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) RevokeSession(id string, at time.Time) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	filter := bson.M{"id": id}
+	update := bson.M{"$min": bson.M{"revokedAt": at}}
+	result, err := c.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) RevokeUserSessions(username string, at time.Time) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("sessions")
+
+	filter := bson.M{"username": username, "revokedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revokedAt": at}}
+	if _, err := c.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("error revoking sessions: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) CreateRefreshToken(token RefreshToken) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("refreshTokens")
+
+	_, err := c.InsertOne(ctx, token)
+	return err
+}
+
+// ***********************************************
+func (db *DBClient) UseRefreshToken(hash string) (RefreshToken, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("refreshTokens")
+
+	// only one of two concurrent refreshes can flip used, the other
+	// finds the token already used and is treated as a reuse
+	var token RefreshToken
+	err := c.FindOneAndUpdate(ctx,
+		bson.M{"hash": hash, "used": false},
+		bson.M{"$set": bson.M{"used": true}},
+	).Decode(&token)
+	if err == nil {
+		return token, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return RefreshToken{}, fmt.Errorf("error using refresh token: %w", err)
+	}
+
+	err = c.FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return RefreshToken{}, ErrNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, ErrRefreshTokenReused
+}
+
+// ***********************************************
+func (db *DBClient) RevokeRefreshFamily(family string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("refreshTokens")
+
+	_, err := c.UpdateMany(ctx, bson.M{"family": family}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	return nil
+}
+
 // ***********************************************
 func (db *DBClient) CreateUser(user User) error {
 	ctx := context.TODO()
 	c := db.client.Database(db.name).Collection("users")
+	// the unique index on username settles concurrent registrations
 	_, err := c.InsertOne(ctx, user)
+	if utils.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
 	return err
 }
 
@@ -228,6 +1111,247 @@ func (db *DBClient) FindUserByUsername(username string) (User, error) {
 	ctx := context.TODO()
 	c := db.client.Database(db.name).Collection("users")
 	f := bson.M{"username": username}
-	err := c.FindOne(ctx, f).Decode(&user)
+	opts := options.FindOne().SetCollation(usernameCollation)
+	err := c.FindOne(ctx, f, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrNotFound
+	}
 	return user, err
 }
+
+// ***********************************************
+func (db *DBClient) SetRecoveryKey(username string, key *RecoveryKey) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("users")
+
+	update := bson.M{"$unset": bson.M{"recovery": ""}}
+	if key != nil {
+		update = bson.M{"$set": bson.M{"recovery": key}}
+	}
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, bson.M{"username": username}, update, opts)
+	if err != nil {
+		return fmt.Errorf("error storing recovery key: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) SetTOTP(username string, totp *TOTP) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("users")
+
+	update := bson.M{"$unset": bson.M{"totp": ""}}
+	if totp != nil {
+		update = bson.M{"$set": bson.M{"totp": totp}}
+	}
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, bson.M{"username": username}, update, opts)
+	if err != nil {
+		return fmt.Errorf("error storing totp: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) UseTOTPStep(username string, step int64) (bool, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("users")
+
+	filter := bson.M{"username": username, "totp.lastStep": bson.M{"$lt": step}}
+	update := bson.M{"$set": bson.M{"totp.lastStep": step}}
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, fmt.Errorf("error using totp step: %w", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// ***********************************************
+func (db *DBClient) UseRecoveryCode(username, hash string) (bool, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("users")
+
+	filter := bson.M{"username": username, "totp.recoveryCodes": hash}
+	update := bson.M{"$pull": bson.M{"totp.recoveryCodes": hash}}
+	opts := options.Update().SetCollation(usernameCollation)
+	result, err := c.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %w", err)
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// ***********************************************
+func (db *DBClient) DeleteUser(username string) error {
+	ctx := context.TODO()
+	users := db.client.Database(db.name).Collection("users")
+
+	opts := options.Delete().SetCollation(usernameCollation)
+	result, err := users.DeleteOne(ctx, bson.M{"username": username}, opts)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %w", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	cursors := db.client.Database(db.name).Collection("deliveryCursors")
+	if _, err := cursors.DeleteMany(ctx, bson.M{"username": username}); err != nil {
+		return fmt.Errorf("error deleting delivery cursors: %w", err)
+	}
+	return nil
+}
+
+// ***********************************************
+func (db *DBClient) RemoveParticipant(username string) ([]Conversation, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("conversations")
+	participant := "participants." + username
+
+	opts := options.Find().SetProjection(bson.M{"messages": 0})
+	cursor, err := c.Find(ctx, bson.M{"members": username}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error finding conversations: %w", err)
+	}
+	var left []Conversation
+	if err := cursor.All(ctx, &left); err != nil {
+		return nil, fmt.Errorf("error decoding conversations: %w", err)
+	}
+
+	update := bson.M{
+		"$unset": bson.M{participant: ""},
+		"$pull":  bson.M{"members": username},
+	}
+	_, err = c.UpdateMany(ctx, bson.M{"members": username}, update)
+	if err != nil {
+		return nil, fmt.Errorf("error removing participant: %w", err)
+	}
+
+	var empty []string
+	for i := range left {
+		delete(left[i].Participants, username)
+		if len(left[i].Participants) == 0 {
+			empty = append(empty, left[i].ID)
+		}
+	}
+	if len(empty) > 0 {
+		// only delete what is still empty, someone may have been added since
+		filter := bson.M{"id": bson.M{"$in": empty}, "participants": bson.M{}}
+		if _, err := c.DeleteMany(ctx, filter); err != nil {
+			return nil, fmt.Errorf("error deleting conversations: %w", err)
+		}
+		messages := db.client.Database(db.name).Collection("messages")
+		if _, err := messages.DeleteMany(ctx, bson.M{"convid": bson.M{"$in": empty}}); err != nil {
+			return nil, fmt.Errorf("error deleting messages: %w", err)
+		}
+	}
+	return left, nil
+}
+
+// ***********************************************
+func (db *DBClient) ScrubUserMessages(username, policy string) error {
+	ctx := context.TODO()
+	messages := db.client.Database(db.name).Collection("messages")
+
+	_, err := messages.UpdateMany(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"receipts." + username: bson.M{"$exists": true}},
+			bson.M{"hiddenFor": username},
+		}},
+		bson.M{
+			"$unset": bson.M{"receipts." + username: ""},
+			"$pull":  bson.M{"hiddenFor": username},
+		})
+	if err != nil {
+		return fmt.Errorf("error removing receipts: %w", err)
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"deleted": true, "content": ""},
+		"$unset": bson.M{"revisions": ""},
+	}
+	if policy == AccountDeletionAnonymize {
+		update = bson.M{"$set": bson.M{"from": DeletedUsername}}
+	}
+	if _, err := messages.UpdateMany(ctx, bson.M{"from": username}, update); err != nil {
+		return fmt.Errorf("error scrubbing messages: %w", err)
+	}
+
+	if policy == AccountDeletionAnonymize {
+		conversations := db.client.Database(db.name).Collection("conversations")
+		_, err := conversations.UpdateMany(ctx,
+			bson.M{"lastMessage.from": username},
+			bson.M{"$set": bson.M{"lastMessage.from": DeletedUsername}})
+		if err != nil {
+			return fmt.Errorf("error scrubbing conversations: %w", err)
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+// AddFailure counts a failed login in one update, so replicas racing on
+// the same key never lose a failure.
+func (db *DBClient) AddFailure(key string, now time.Time, window time.Duration) (int, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("loginAttempts")
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$last", now.Add(-window)}},
+				bson.M{"$add": bson.A{"$failures", 1}},
+				1,
+			}},
+			"last":      now,
+			"expiresAt": now.Add(window),
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var attempts struct {
+		Failures int `bson:"failures"`
+	}
+	err := c.FindOneAndUpdate(ctx, bson.M{"key": key}, update, opts).Decode(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("error counting login failure: %w", err)
+	}
+	return attempts.Failures, nil
+}
+
+// ***********************************************
+func (db *DBClient) Failures(key string, now time.Time, window time.Duration) (int, time.Time, error) {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("loginAttempts")
+
+	var attempts struct {
+		Failures int       `bson:"failures"`
+		Last     time.Time `bson:"last"`
+	}
+	filter := bson.M{"key": key, "last": bson.M{"$gt": now.Add(-window)}}
+	err := c.FindOne(ctx, filter).Decode(&attempts)
+	if err == mongo.ErrNoDocuments {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("error finding login failures: %w", err)
+	}
+	return attempts.Failures, attempts.Last, nil
+}
+
+// ***********************************************
+func (db *DBClient) ResetFailures(key string) error {
+	ctx := context.TODO()
+	c := db.client.Database(db.name).Collection("loginAttempts")
+
+	if _, err := c.DeleteOne(ctx, bson.M{"key": key}); err != nil {
+		return fmt.Errorf("error resetting login failures: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+var (
+	errNotAuthor    = errors.New("only the author can do that")
+	errUnknownScope = errors.New("scope must be me or everyone")
+)
+
+// ***********************************************
+// deleteMessage deletes a message in conversationID, if given, for
+// username alone or for everyone, and tells the devices that need to
+// know. Only the author may delete for everyone; that leaves a tombstone
+// so the id stays valid for cursors and receipts.
+func deleteMessage(username, conversationID, messageID, scope string) error {
+	if scope != DeleteForMe && scope != DeleteForEveryone {
+		return errUnknownScope
+	}
+
+	message, err := db.GetMessage(messageID)
+	if err != nil {
+		return err
+	}
+	if conversationID != "" && conversationID != message.ConvID {
+		return ErrNotFound
+	}
+	conversation, err := authorizeConversation(username, message.ConvID)
+	if err != nil {
+		return err
+	}
+
+	notify := []string{username}
+	if scope == DeleteForMe {
+		err = db.HideMessage(message.ID, username)
+	} else {
+		if message.From != username {
+			return errNotAuthor
+		}
+		err = db.TombstoneMessage(message.ID)
+		notify = participantNames(conversation, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	notifyDeletion(notify, DeletePayload{MessageID: message.ID, ConvID: message.ConvID, Scope: scope})
+	return nil
+}
+
+// ***********************************************
+// notifyDeletion sends a delete event to every device of usernames.
+// Version 0 clients learn about it the way they always have, from a
+// conversationUpdate carrying the conversation as they now see it.
+func notifyDeletion(usernames []string, deletion DeletePayload) {
+	broadcast(usernames, FrameDelete, "", deletion)
+	sendConversationUpdate(usernames, deletion.ConvID)
+}
+
+// ***********************************************
+// sendConversationUpdate sends the version 0 devices of usernames the
+// conversation as each of them now sees it.
+func sendConversationUpdate(usernames []string, convID string) {
+	for _, username := range usernames {
+		var legacy []*Conn
+		for _, deviceConn := range clients.Devices(username) {
+			if deviceConn.Version == 0 {
+				legacy = append(legacy, deviceConn)
+			}
+		}
+		if len(legacy) == 0 {
+			continue
+		}
+
+		conversation, err := db.GetUserConversation(username, convID)
+		if err != nil {
+			log.Println("Error fetching updated conversation:", err)
+			continue
+		}
+		page := MessagePage{Limit: maxPageLimit, Viewer: username}
+		conversation.Messages, _, err = db.GetMessagePage(convID, page)
+		if err != nil {
+			log.Println("Error fetching updated conversation:", err)
+			continue
+		}
+		response := DeleteMessageResponse{
+			Type:         "conversationUpdate",
+			Conversation: conversation,
+		}
+		for _, deviceConn := range legacy {
+			deviceConn.SendJSON(response)
+		}
+	}
+}
+
+// ***********************************************
+func handleDeleteFrame(conn *Conn, env Envelope) {
+	var deletion DeletePayload
+	if !decodePayload(conn, env, &deletion) {
+		return
+	}
+	if deletion.Scope == "" {
+		deletion.Scope = DeleteForMe
+	}
+
+	err := deleteMessage(conn.Username, deletion.ConvID, deletion.MessageID, deletion.Scope)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		sendError(conn, env.ID, "not_found", "message not found")
+	case errNotAuthor:
+		sendError(conn, env.ID, "forbidden", err.Error())
+	case errUnknownScope:
+		sendError(conn, env.ID, "bad_request", err.Error())
+	default:
+		log.Println("delete err", err)
+		sendError(conn, env.ID, "internal", "could not delete message")
+	}
+}
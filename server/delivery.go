@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const replayBatchSize = 200
+
+var (
+	messageClockMu       sync.Mutex
+	lastMessageTimestamp time.Time
+)
+
+// ***********************************************
+// nextMessageTimestamp returns the server time for a new message.
+// MongoDB keeps milliseconds, so the time is truncated to keep cursors
+// exact, and it always moves forward so two messages sent within the
+// same millisecond still sort in the order they arrived instead of by
+// their random ids.
+func nextMessageTimestamp() time.Time {
+	messageClockMu.Lock()
+	defer messageClockMu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if !now.After(lastMessageTimestamp) {
+		now = lastMessageTimestamp.Add(time.Millisecond)
+	}
+	lastMessageTimestamp = now
+	return now
+}
+
+// ***********************************************
+// replayMissed queues every message stored since the device's delivery
+// cursor, oldest first. The caller holds conn so live traffic waits
+// until the replay is queued.
+//
+// The cursor is a position in timestamp order, not a set of acked
+// messages. A message stored after a later-stamped one was acked, such
+// as one sent through another replica with a slower clock, is behind
+// the cursor and is not replayed; the client finds it in the history.
+func replayMissed(conn *Conn) error {
+	cursor, err := db.GetDeliveryCursor(conn.Username, conn.CursorDevice)
+	if err == ErrNotFound {
+		// first connection of this device: start from now rather than
+		// replaying the user's entire history
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		return db.AdvanceDeliveryCursor(conn.Username, conn.CursorDevice, Cursor{Timestamp: now})
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		messages, err := db.GetMessagesSince(conn.Username, cursor, replayBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			data, err := encodeFrame(conn.Version, FrameMessage, message.ID, message)
+			if err != nil {
+				return err
+			}
+			if !conn.Replay(message.ID, data) {
+				return nil
+			}
+		}
+		if len(messages) < replayBatchSize {
+			return nil
+		}
+		cursor = cursorForMessage(messages[len(messages)-1])
+	}
+}
+
+// ***********************************************
+// handleAck records that a message reached one of the user's devices, or
+// was read there. It moves the delivery cursor up to the message and
+// tells the other participants when the receipt is new. Acks may arrive
+// out of order; the cursor only moves forward.
+func handleAck(conn *Conn, env Envelope) {
+	var ack AckPayload
+	if !decodePayload(conn, env, &ack) {
+		return
+	}
+	if ack.MessageID == "" {
+		sendError(conn, env.ID, "bad_request", "messageId is required")
+		return
+	}
+	if ack.Status == "" {
+		ack.Status = ReceiptDelivered
+	}
+	if ack.Status != ReceiptDelivered && ack.Status != ReceiptRead {
+		sendError(conn, env.ID, "bad_request", "unknown ack status")
+		return
+	}
+
+	message, err := db.GetMessage(ack.MessageID)
+	var conversation Conversation
+	if err == nil {
+		conversation, err = authorizeConversation(conn.Username, message.ConvID)
+	}
+	if err == ErrNotFound {
+		sendError(conn, env.ID, "not_found", "message not found")
+		return
+	}
+	if err != nil {
+		log.Println("ack err", err)
+		sendError(conn, env.ID, "internal", "could not record ack")
+		return
+	}
+
+	if err := db.AdvanceDeliveryCursor(conn.Username, conn.CursorDevice, cursorForMessage(message)); err != nil {
+		log.Println("ack err", err)
+		sendError(conn, env.ID, "internal", "could not record ack")
+		return
+	}
+
+	// the author's own devices ack their echo too, which is no receipt
+	if message.From == conn.Username {
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	changed, err := db.RecordReceipt(message.ID, conn.Username, ack.Status, now)
+	if err != nil {
+		log.Println("receipt err", err)
+		sendError(conn, env.ID, "internal", "could not record ack")
+		return
+	}
+	if !changed {
+		return
+	}
+	// reading a message is reading the conversation up to it
+	if ack.Status == ReceiptRead {
+		if err := db.MarkConversationRead(message.ConvID, conn.Username); err != nil {
+			log.Println("mark read err", err)
+		}
+	}
+
+	receipt := ReceiptPayload{
+		MessageID: message.ID,
+		ConvID:    message.ConvID,
+		Username:  conn.Username,
+		Status:    ack.Status,
+		Timestamp: now,
+	}
+	broadcast(participantNames(conversation, conn.Username), FrameReceipt, "", receipt)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// maxRevisions bounds how many replaced versions a message keeps.
+const maxRevisions = 10
+
+var errEmptyContent = errors.New("content is required")
+
+// ***********************************************
+// editMessage replaces the content of a message by its author and tells
+// every participant. Content is ciphertext under the conversation's key,
+// like the message it replaces.
+func editMessage(username, conversationID, messageID, content string) (Message, error) {
+	if content == "" {
+		return Message{}, errEmptyContent
+	}
+
+	message, err := db.GetMessage(messageID)
+	if err != nil {
+		return Message{}, err
+	}
+	if conversationID != "" && conversationID != message.ConvID {
+		return Message{}, ErrNotFound
+	}
+	conversation, err := authorizeConversation(username, message.ConvID)
+	if err != nil {
+		return Message{}, err
+	}
+	if message.From != username {
+		return Message{}, errNotAuthor
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	edited, err := db.EditMessage(message.ID, content, now)
+	if err != nil {
+		return Message{}, err
+	}
+
+	broadcast(participantNames(conversation, ""), FrameEdit, "", EditPayload{
+		MessageID: edited.ID,
+		ConvID:    edited.ConvID,
+		Content:   edited.Content,
+		EditedAt:  edited.EditedAt,
+	})
+	return edited, nil
+}
+
+// ***********************************************
+func handleEditFrame(conn *Conn, env Envelope) {
+	var edit EditPayload
+	if !decodePayload(conn, env, &edit) {
+		return
+	}
+
+	_, err := editMessage(conn.Username, edit.ConvID, edit.MessageID, edit.Content)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		sendError(conn, env.ID, "not_found", "message not found")
+	case errNotAuthor:
+		sendError(conn, env.ID, "forbidden", err.Error())
+	case errEmptyContent:
+		sendError(conn, env.ID, "bad_request", err.Error())
+	default:
+		log.Println("edit err", err)
+		sendError(conn, env.ID, "internal", "could not edit message")
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joemafrici/argo/utils"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -26,7 +27,13 @@ func HandleSendSalt(w http.ResponseWriter, r *http.Request) {
 		Salt string `json:"salt"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&saltRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeDecodeError(w, err)
+		return
+	}
+	var invalid ValidationError
+	validateBase64(&invalid, "salt", saltRequest.Salt, minSaltBytes)
+	if invalid.err() != nil {
+		writeValidationError(w, &invalid)
 		return
 	}
 	username, ok := r.Context().Value("username").(string)
@@ -56,7 +63,14 @@ func HandleSendKeys(w http.ResponseWriter, r *http.Request) {
 		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&keysRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeDecodeError(w, err)
+		return
+	}
+	var invalid ValidationError
+	validatePublicKey(&invalid, "publicKey", keysRequest.PublicKey)
+	validateBase64(&invalid, "encryptedPrivateKey", keysRequest.EncryptedPrivateKey, minWrappedKeyBytes)
+	if invalid.err() != nil {
+		writeValidationError(w, &invalid)
 		return
 	}
 
@@ -76,199 +90,939 @@ func HandleSendKeys(w http.ResponseWriter, r *http.Request) {
 }
 
 // ***********************************************
+// HandleDeleteMessage deletes a message for the caller only, or, for the
+// author, for everyone. Scope defaults to me, as it does for delete
+// frames, so deleting for everyone is never done by accident.
 func HandleDeleteMessage(w http.ResponseWriter, r *http.Request) {
-	log.Println("message delete not available")
-	/*
+	if r.Method != "DELETE" {
+		log.Println("Method not allowed")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		if r.Method != "DELETE" {
-			log.Println("Method not allowed")
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
 
-		var deleteRequest struct {
-			ConversationID string `json:"currentConversationID"`
-			MessageID      string `json:"messageID"`
-		}
+	var deleteRequest struct {
+		ConversationID string `json:"currentConversationID"`
+		MessageID      string `json:"messageID"`
+		Scope          string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteRequest); err != nil {
+		log.Println("Bad request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if deleteRequest.Scope == "" {
+		deleteRequest.Scope = DeleteForMe
+	}
 
-		if err := json.NewDecoder(r.Body).Decode(&deleteRequest); err != nil {
-			log.Println("Bad request")
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	err := deleteMessage(username, deleteRequest.ConversationID, deleteRequest.MessageID, deleteRequest.Scope)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case ErrNotFound:
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errNotAuthor:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errUnknownScope:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error deleting message: %v", err)
+		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+	}
+}
 
-		c := dbclient.Database(dbname).Collection("conversations")
-		f := bson.M{
-			"id":          deleteRequest.ConversationID,
-			"messages.id": deleteRequest.MessageID,
-		}
+// ***********************************************
+// HandleEditMessage replaces the content of one of the caller's messages
+// and responds with the current version.
+func HandleEditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		u := bson.M{
-			"$pull": bson.M{
-				"messages": bson.M{"id": deleteRequest.MessageID},
-			},
-		}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
 
-		_, err := c.UpdateOne(context.TODO(), f, u)
+	var editRequest struct {
+		ConversationID string `json:"conversationId"`
+		MessageID      string `json:"messageId"`
+		Content        string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&editRequest); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	message, err := editMessage(username, editRequest.ConversationID, editRequest.MessageID, editRequest.Content)
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(message)
+	case ErrNotFound:
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errNotAuthor:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errEmptyContent:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Error editing message: %v", err)
+		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+	}
+}
+
+// ***********************************************
+func HandleRegister(w http.ResponseWriter, r *http.Request) {
+	var newUser registration
+	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
+		log.Println(err.Error())
+		writeDecodeError(w, err)
+		return
+	}
+	// usernames are stored lowercase so "Alice" and "alice" are one user
+	newUser.Username = normalizeUsername(newUser.Username)
+	if err := newUser.validate(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	var recovery *RecoveryKey
+	if newUser.RecoveryVerifier != "" {
+		recovery = newRecoveryKey(newUser.RecoveryEncryptedPrivateKey, newUser.RecoverySaltBase64, newUser.RecoveryVerifier)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	userToInsert := User{
+		Username:            newUser.Username,
+		Password:            string(hashedPassword),
+		PublicKey:           newUser.PublicKey,
+		EncryptedPrivateKey: newUser.EncryptedPrivateKey,
+		SaltBase64:          newUser.SaltBase64,
+		Recovery:            recovery,
+	}
+
+	// no lookup first: two registrations racing for one name would both
+	// pass it, the unique index lets only one through
+	err = db.CreateUser(userToInsert)
+	if err == ErrDuplicate {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		utils.HandleDatabaseError(err)
+		http.Error(w, "Failed to create new user", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ***********************************************
+func HandleLogin(w http.ResponseWriter, r *http.Request) {
+	var loginUser User
+	if err := json.NewDecoder(r.Body).Decode(&loginUser); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// throttle before bcrypt so guessing costs the server nothing
+	ip := clientIP(r)
+	if throttleLogin(w, loginUser.Username, ip) {
+		return
+	}
+
+	var storedUser User
+	storedUser, err := findUser(loginUser.Username)
+	if err != nil {
+		limiter.Fail(loginUser.Username, ip, time.Now())
+		http.Error(w, "user not found", http.StatusUnauthorized)
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(loginUser.Password))
+	if err != nil {
+		log.Println("Invalid Credentials", err)
+		limiter.Fail(loginUser.Username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// the limiter only forgets the failures once the second factor is in,
+	// or a known password would let codes be guessed forever
+	if storedUser.TOTP != nil && storedUser.TOTP.Enabled {
+		challenge, err := utils.NewChallengeToken(storedUser.Username)
 		if err != nil {
-			log.Printf("Error deleting message: %v", err)
-			http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+			log.Println("challenge err", err)
+			http.Error(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
+		json.NewEncoder(w).Encode(TwoFactorChallenge{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			ExpiresIn:         int(utils.ChallengeTokenTTL.Seconds()),
+		})
+		return
+	}
+	limiter.Succeed(storedUser.Username)
+	finishLogin(w, r, storedUser)
+}
+
+// ***********************************************
+// HandleLoginTOTP is the second step of logging in with TOTP enabled. It
+// takes the challenge token from HandleLogin and either a code or a
+// recovery code.
+func HandleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var loginRequest struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&loginRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username, err := utils.ValidateChallengeToken(loginRequest.ChallengeToken)
+	if err != nil {
+		http.Error(w, "Invalid challenge token", http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	storedUser, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "user not found", http.StatusUnauthorized)
+		return
+	}
+	err = verifySecondFactor(storedUser, loginRequest.Code, loginRequest.RecoveryCode)
+	if err == errInvalidCode || err == errTOTPNotEnabled {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("totp err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	limiter.Succeed(username)
+	finishLogin(w, r, storedUser)
+}
 
-		var updatedConversation Conversation
-		err = c.FindOne(context.TODO(), bson.M{"id": deleteRequest.ConversationID}).Decode(&updatedConversation)
+// ***********************************************
+// throttleLogin answers with 429 if logins for username from ip have to
+// wait, and reports whether it did.
+func throttleLogin(w http.ResponseWriter, username, ip string) bool {
+	wait := limiter.Wait(username, ip, time.Now())
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+	return true
+}
+
+// ***********************************************
+// finishLogin starts a session for the user and sends its tokens along
+// with the user's keys.
+func finishLogin(w http.ResponseWriter, r *http.Request, storedUser User) {
+	session, err := startSession(storedUser.Username, r)
+	if err != nil {
+		log.Println("session err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := issueTokens(storedUser.Username, session.ID)
+	if err != nil {
+		log.Println("issue tokens err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	response := LoginResponse{
+		TokenResponse: tokens,
+		Keys: struct {
+			Public           string `json:"public"`
+			EncryptedPrivate string `json:"encryptedPrivate"`
+			SaltBase64       string `json:"saltBase64"`
+		}{
+			Public:           storedUser.PublicKey,
+			EncryptedPrivate: storedUser.EncryptedPrivateKey,
+			SaltBase64:       storedUser.SaltBase64,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// ***********************************************
+// HandleChangePassword sets a new password along with the private key the
+// client re-wrapped with it, then logs out every other session.
+func HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	var changeRequest struct {
+		OldPassword         string `json:"oldPassword"`
+		NewPassword         string `json:"newPassword"`
+		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+		SaltBase64          string `json:"saltBase64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&changeRequest); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	// the re-wrapped key replaces the only copy the server has, so a
+	// malformed one would lose the user's private key
+	var invalid ValidationError
+	validatePassword(&invalid, "newPassword", changeRequest.NewPassword, username)
+	validateWrappedKey(&invalid, "encryptedPrivateKey", changeRequest.EncryptedPrivateKey, "saltBase64", changeRequest.SaltBase64)
+	if invalid.err() != nil {
+		writeValidationError(w, &invalid)
+		return
+	}
+
+	// a stolen access token should not be a way to guess the password
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(changeRequest.OldPassword)) != nil {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(changeRequest.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = db.ChangePassword(username, user.Password, string(hashedPassword), changeRequest.EncryptedPrivateKey, changeRequest.SaltBase64)
+	if err == ErrNotFound {
+		http.Error(w, "Password was changed by another request", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("change password err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	limiter.Succeed(username)
+
+	if err := revokeOtherSessions(username, sessionID); err != nil {
+		log.Println("revoke sessions err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ***********************************************
+// HandleSetRecoveryKey sets up or replaces the user's recovery key. It
+// takes the password, since a recovery key is a way into the account.
+func HandleSetRecoveryKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	var keyRequest struct {
+		Password            string `json:"password"`
+		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+		SaltBase64          string `json:"saltBase64"`
+		Verifier            string `json:"verifier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&keyRequest); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	var invalid ValidationError
+	validateRecoveryKey(&invalid,
+		"encryptedPrivateKey", keyRequest.EncryptedPrivateKey,
+		"saltBase64", keyRequest.SaltBase64,
+		"verifier", keyRequest.Verifier)
+	if invalid.err() != nil {
+		writeValidationError(w, &invalid)
+		return
+	}
+	recovery := newRecoveryKey(keyRequest.EncryptedPrivateKey, keyRequest.SaltBase64, keyRequest.Verifier)
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(keyRequest.Password)) != nil {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := db.SetRecoveryKey(username, recovery); err != nil {
+		log.Println("set recovery key err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ***********************************************
+// HandleRecoveryKey returns the recovery copy of the private key to a
+// client that proves it has the recovery key, so it can unwrap it.
+func HandleRecoveryKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var recoverRequest struct {
+		Username string `json:"username"`
+		Verifier string `json:"verifier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&recoverRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, recoverRequest.Username, ip) {
+		return
+	}
+	user, err := checkRecoveryVerifier(recoverRequest.Username, recoverRequest.Verifier)
+	if err == errInvalidRecoveryKey {
+		limiter.Fail(recoverRequest.Username, ip, time.Now())
+		http.Error(w, "Invalid recovery key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("recovery err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryBundle{
+		EncryptedPrivateKey: user.Recovery.EncryptedPrivateKey,
+		SaltBase64:          user.Recovery.SaltBase64,
+	})
+}
+
+// ***********************************************
+// HandleRecover sets a new password for a user who proves they have the
+// recovery key, along with the private key the client re-wrapped under
+// it, and logs out every session.
+func HandleRecover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var recoverRequest struct {
+		Username            string `json:"username"`
+		Verifier            string `json:"verifier"`
+		NewPassword         string `json:"newPassword"`
+		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+		SaltBase64          string `json:"saltBase64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&recoverRequest); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	var invalid ValidationError
+	validatePassword(&invalid, "newPassword", recoverRequest.NewPassword, normalizeUsername(recoverRequest.Username))
+	validateWrappedKey(&invalid, "encryptedPrivateKey", recoverRequest.EncryptedPrivateKey, "saltBase64", recoverRequest.SaltBase64)
+	if invalid.err() != nil {
+		writeValidationError(w, &invalid)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, recoverRequest.Username, ip) {
+		return
+	}
+	user, err := checkRecoveryVerifier(recoverRequest.Username, recoverRequest.Verifier)
+	if err == errInvalidRecoveryKey {
+		limiter.Fail(recoverRequest.Username, ip, time.Now())
+		http.Error(w, "Invalid recovery key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("recovery err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(recoverRequest.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = db.ChangePassword(user.Username, user.Password, string(hashedPassword), recoverRequest.EncryptedPrivateKey, recoverRequest.SaltBase64)
+	if err == ErrNotFound {
+		http.Error(w, "Password was changed by another request", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("recover err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	limiter.Succeed(user.Username)
+
+	// whoever knew the old password is logged out
+	if err := revokeUserSessions(user.Username); err != nil {
+		log.Println("revoke sessions err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ***********************************************
+// HandleDeleteAccount deletes the user's account. It takes the password,
+// and a second factor if the user has one, however fresh the token.
+func HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	var deleteRequest struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(deleteRequest.Password)) != nil {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTP != nil && user.TOTP.Enabled {
+		err := verifySecondFactor(user, deleteRequest.Code, deleteRequest.RecoveryCode)
+		if err == errInvalidCode {
+			limiter.Fail(username, ip, time.Now())
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
-			log.Println("Error fetching updated conversation:", err)
-			http.Error(w, "Failed to fetch updated conversation", http.StatusInternalServerError)
+			log.Println("totp err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+	}
 
-		response := DeleteMessageResponse{
-			Type:         "conversationUpdate",
-			Conversation: updatedConversation,
+	if err := deleteAccount(username); err != nil {
+		log.Println("delete account err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ***********************************************
+// HandleTOTPEnroll starts enrolling a TOTP second factor. It is not
+// enabled until HandleTOTPVerify sees a code from it. It takes the
+// password, or a stolen access token could enable a second factor the
+// owner does not have and lock them out.
+func HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	var enrollRequest struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&enrollRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(enrollRequest.Password)) != nil {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTP != nil && user.TOTP.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println("totp secret err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.SetTOTP(username, &TOTP{Secret: secret}); err != nil {
+		log.Println("set totp err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollment{Secret: secret, URI: totpURI(username, secret)})
+}
+
+// ***********************************************
+// HandleTOTPVerify enables the enrolled second factor once the user shows
+// a code from it, and returns the recovery codes. They are never shown
+// again.
+func HandleTOTPVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	var verifyRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&verifyRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTP == nil {
+		http.Error(w, "Two-factor authentication is not being enrolled", http.StatusBadRequest)
+		return
+	}
+	if user.TOTP.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	step, ok := matchTOTP(user.TOTP.Secret, verifyRequest.Code, time.Now())
+	if !ok {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println("recovery codes err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	totp := &TOTP{Secret: user.TOTP.Secret, Enabled: true, LastStep: step, RecoveryCodes: hashes}
+	if err := db.SetTOTP(username, totp); err != nil {
+		log.Println("set totp err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// ***********************************************
+// HandleTOTPDisable turns the second factor off. It takes the password
+// and a code or recovery code, so a stolen access token is not enough.
+func HandleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	var disableRequest struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&disableRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttleLogin(w, username, ip) {
+		return
+	}
+	user, err := db.FindUserByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(disableRequest.Password)) != nil {
+		limiter.Fail(username, ip, time.Now())
+		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTP != nil && user.TOTP.Enabled {
+		err := verifySecondFactor(user, disableRequest.Code, disableRequest.RecoveryCode)
+		if err == errInvalidCode {
+			limiter.Fail(username, ip, time.Now())
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
 		}
-		responseJSON, err := json.Marshal(response)
 		if err != nil {
-			log.Println("Error marshalling response:", err)
+			log.Println("totp err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		clientsMu.RLock()
-		// TODO: need to determine if I need to echo the updated conversation
-		// back to the user that requested the delete
-
-		for _, participant := range updatedConversation.Participants {
-			ws, ok := clients[participant]
-			if !ok {
-				log.Println("No websocket connection found for user:", participant, err)
-				continue
-			}
+	}
 
-			if err := ws.WriteMessage(websocket.TextMessage, responseJSON); err != nil {
-				log.Println("Error sending message over WebSocket to user:", participant, err)
-			}
-		}
+	if err := db.SetTOTP(username, nil); err != nil {
+		log.Println("set totp err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		clientsMu.RUnlock()
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(updatedConversation)
-	*/
+// ***********************************************
+// HandleJWKS publishes the public signing keys so other services can
+// verify access tokens.
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jwks, err := utils.PublicJWKS()
+	if err != nil {
+		log.Println("jwks err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
 }
 
-// ***********************************************
-func HandleRegister(w http.ResponseWriter, r *http.Request) {
-	var newUser struct {
-		Username            string `json:"username"`
-		Password            string `json:"password"`
-		PublicKey           string `json:"publicKey"`
-		SaltBase64          string `json:"saltBase64"`
-		EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+// ***********************************************
+// HandleRefresh trades a refresh token for a new access token and a new
+// refresh token. Each refresh token works once. Presenting one again
+// means it was copied, so the whole family is revoked and the user has
+// to log in again.
+func HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Println(err.Error())
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	_, err := db.FindUserByUsername(newUser.Username)
-
-	if err == nil {
-		http.Error(w, "User already exists", http.StatusConflict)
+	stored, err := db.UseRefreshToken(hashRefreshToken(req.RefreshToken))
+	if err == ErrRefreshTokenReused {
+		log.Println("refresh token reused for", stored.Username, "revoking session", stored.Family)
+		if err := db.RevokeRefreshFamily(stored.Family); err != nil {
+			log.Println("revoke err", err)
+		}
+		if err := revokeSession(stored.Username, stored.Family); err != nil && err != ErrNotFound {
+			log.Println("revoke err", err)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
-	} else if err != mongo.ErrNoDocuments {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+	if err == ErrNotFound {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("refresh err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if stored.Revoked || time.Now().After(stored.ExpiresAt) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	// logging out revokes the session, not each of its refresh tokens
+	if err := checkSession(stored.Family); err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	tokens, err := issueTokens(stored.Username, stored.Family)
 	if err != nil {
+		log.Println("issue tokens err", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
 
-	userToInsert := User{
-		Username:            newUser.Username,
-		Password:            string(hashedPassword),
-		PublicKey:           newUser.PublicKey,
-		EncryptedPrivateKey: newUser.EncryptedPrivateKey,
-		SaltBase64:          newUser.SaltBase64,
+// ***********************************************
+// HandleLogout ends the session the request was made with.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	err = db.CreateUser(userToInsert)
-	if err != nil {
-		http.Error(w, "Failed to create new user", http.StatusInternalServerError)
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+	sessionID, ok := r.Context().Value("sessionID").(string)
+	if !ok {
+		http.Error(w, "Invalid session context", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	if err := revokeSession(username, sessionID); err != nil {
+		log.Println("logout err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 // ***********************************************
-func HandleLogin(w http.ResponseWriter, r *http.Request) {
-	var loginUser User
-	if err := json.NewDecoder(r.Body).Decode(&loginUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// HandleSessions lists the user's sessions on GET and revokes one of them
+// on DELETE.
+func HandleSessions(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
 		return
 	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
 
-	var storedUser User
-	storedUser, err := db.FindUserByUsername(loginUser.Username)
-	if err != nil {
-		http.Error(w, "user not found", http.StatusUnauthorized)
+	switch r.Method {
+	case "GET":
+		sessions, err := listSessions(username, sessionID)
+		if err != nil {
+			log.Println("sessions err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	case "DELETE":
+		var revokeRequest struct {
+			SessionID string `json:"sessionId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&revokeRequest); err != nil || revokeRequest.SessionID == "" {
+			http.Error(w, "sessionId is required", http.StatusBadRequest)
+			return
+		}
+		err := revokeSession(username, revokeRequest.SessionID)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case ErrNotFound:
+			http.Error(w, "Session not found", http.StatusNotFound)
+		default:
+			log.Println("revoke session err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(loginUser.Password))
-	if err != nil {
-		log.Println("Invalid Credentials", err)
-		http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+// ***********************************************
+// HandleLogoutAll ends every session of the user, on every device.
+func HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	tokenString, err := utils.NewTokenString(loginUser.Username)
-	if err != nil {
-		http.Error(w, "Server Error", http.StatusInternalServerError)
+
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
 		return
 	}
 
-	response := LoginResponse{
-		Token: tokenString,
-		Keys: struct {
-			Public           string `json:"public"`
-			EncryptedPrivate string `json:"encryptedPrivate"`
-			SaltBase64       string `json:"saltBase64"`
-		}{
-			Public:           storedUser.PublicKey,
-			EncryptedPrivate: storedUser.EncryptedPrivateKey,
-			SaltBase64:       storedUser.SaltBase64,
-		},
+	if err := revokeUserSessions(username); err != nil {
+		log.Println("logout all err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-
-	json.NewEncoder(w).Encode(response)
+	w.WriteHeader(http.StatusOK)
 }
 
-// ***********************************************
-// This function is not needed right now.
-// Could be needed in the future if I want a user to be able to log out
-// on one client and still be logged in on another.
-//
-//	func HandleLogout(w http.ResponseWriter, r *http.Request) {
-//		log.Println("in HandleLogout")
-//		// get username from request
-//		//username := r.Context().Value("username").(string)
-//
-//		clientsMu.Lock()
-//		conn, exists := clients[username]
-//		if exists {
-//			closeConnection(conn)
-//			delete(clients, username)
-//		}
-//		clientsMu.Unlock()
-//
-//		clientsMu.RLock()
-//		log.Println(clients)
-//		clientsMu.RUnlock()
-//	}
-//
 // ***********************************************
 func validateAndFetchParticipants(requestParticipants []struct {
 	Username  string `json:"username"`
@@ -276,15 +1030,16 @@ func validateAndFetchParticipants(requestParticipants []struct {
 }, currentUser string) (map[string]Participant, error) {
 	participants := make(map[string]Participant)
 	for _, p := range requestParticipants {
-		user, err := db.FindUserByUsername(p.Username)
+		user, err := findUser(p.Username)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
+			if err == ErrNotFound {
 				return nil, fmt.Errorf("User %s does not exist", p.Username)
 			}
 			return nil, fmt.Errorf("Failed to fetch user %s: %w", p.Username, err)
 		}
 
-		participants[p.Username] = Participant{
+		// keyed by the stored name, which may differ in case from the request
+		participants[user.Username] = Participant{
 			Username:  user.Username,
 			PublicKey: user.PublicKey,
 		}
@@ -332,7 +1087,9 @@ func HandleCreateConversation(w http.ResponseWriter, r *http.Request) {
 		Participants: participants,
 	}
 	if err := db.CreateConversation(newConversation); err != nil {
+		log.Println("create conversation err", err)
 		http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+		return
 	}
 
 	json.NewEncoder(w).Encode(newConversation)
@@ -357,16 +1114,25 @@ func HandleSymmetricKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeDecodeError(w, err)
+		return
 	}
 
-	conversation, err := db.GetUserConversation(usr, req.ConversationID)
+	conversation, err := authorizeConversation(usr, req.ConversationID)
 	if err != nil {
-		http.Error(w, "Conversation not found", http.StatusNotFound)
+		writeAuthorizationError(w, err)
 		return
 	}
-	if _, exists := conversation.Participants[usr]; !exists {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	var v ValidationError
+	for username, encryptedKey := range req.EncryptedKeys {
+		if _, exists := conversation.Participants[username]; !exists {
+			http.Error(w, username+" is not a participant", http.StatusBadRequest)
+			return
+		}
+		validateBase64(&v, "EncryptedKeys."+username, encryptedKey, minWrappedKeyBytes)
+	}
+	if v.err() != nil {
+		writeValidationError(w, &v)
 		return
 	}
 
@@ -406,14 +1172,86 @@ func HandleGetUserConversation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conversation, err := db.GetUserConversation(username, conversationID)
+	page, err := parseMessagePage(r.URL.Query())
 	if err != nil {
-		log.Println("conversations err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page.Viewer = username
+
+	conversation, err := authorizeConversation(username, conversationID)
+	if err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	messages, hasMore, err := db.GetMessagePage(conversationID, page)
+	if err != nil {
+		log.Println("messages err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	conversation.Messages = messages
+
+	response := ConversationPage{
+		Conversation: conversation,
+		NextCursor:   page.nextCursor(messages, hasMore),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ***********************************************
+// HandleGetReceipts returns the delivered and read state of a page of a
+// conversation's messages. It takes the same cursors as /api/conversation.
+func HandleGetReceipts(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+
+	conversationID := r.URL.Query().Get("id")
+	if conversationID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	page, err := parseMessagePage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page.Viewer = username
+
+	if _, err := authorizeConversation(username, conversationID); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	messages, hasMore, err := db.GetMessagePage(conversationID, page)
+	if err != nil {
+		log.Println("receipts err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+
+	response := ReceiptPage{
+		Receipts:   make([]MessageReceipts, 0, len(messages)),
+		NextCursor: page.nextCursor(messages, hasMore),
+	}
+	for _, message := range messages {
+		receipts := message.Receipts
+		if receipts == nil {
+			receipts = map[string]Receipt{}
+		}
+		response.Receipts = append(response.Receipts, MessageReceipts{
+			MessageID: message.ID,
+			Receipts:  receipts,
+		})
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(conversation)
+	json.NewEncoder(w).Encode(response)
 }
 
 // ***********************************************
@@ -434,6 +1272,11 @@ func HandleGetUserConversations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("view") == "summary" {
+		writeConversationSummaries(w, r, username)
+		return
+	}
+
 	conversations, err := db.GetUserConversations(username)
 	if err != nil {
 		log.Println("conversations err", err)
@@ -445,6 +1288,72 @@ func HandleGetUserConversations(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(conversations)
 }
 
+// ***********************************************
+// writeConversationSummaries answers /api/conversations?view=summary with
+// one page of conversations, most recently active first.
+func writeConversationSummaries(w http.ResponseWriter, r *http.Request, username string) {
+	page, err := parseSummaryPage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conversations, hasMore, err := db.GetConversationSummaries(username, page)
+	if err != nil {
+		log.Println("conversation summaries err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	response := ConversationSummaryPage{
+		Conversations: make([]ConversationSummary, 0, len(conversations)),
+	}
+	for _, conversation := range conversations {
+		response.Conversations = append(response.Conversations, conversation.SummaryFor(username))
+	}
+	if hasMore {
+		response.NextCursor = cursorForConversation(conversations[len(conversations)-1]).Encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ***********************************************
+func HandleMarkConversationRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Invalid user context", http.StatusInternalServerError)
+		return
+	}
+
+	var req struct {
+		ConversationID string `json:"conversationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := db.MarkConversationRead(req.ConversationID, username)
+	if err == ErrNotFound {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("mark read err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // ***********************************************
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
@@ -467,7 +1376,9 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var authMessage struct {
-		Token string `json:"token"`
+		Token    string `json:"token"`
+		DeviceID string `json:"deviceId"`
+		V        int    `json:"v"`
 	}
 	if err := json.Unmarshal(message, &authMessage); err != nil {
 		log.Println("Invalid authentication message")
@@ -475,121 +1386,162 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, err := utils.ValidateTokenFromString(authMessage.Token)
+	username, sessionID, err := utils.ValidateSessionToken(authMessage.Token)
 	if err != nil {
 		log.Println("Invalid token:", err)
 		conn.WriteMessage(websocket.CloseMessage, []byte("Invalid token"))
 		return
 	}
 
-	clientsMu.Lock()
-	if oldConn, ok := clients[username]; ok {
-		log.Println("WebSocket connection already exists for", username)
-		closeConnection(oldConn)
+	// clients that do not identify their device get a fresh id, so each
+	// of their connections is treated as a separate device
+	deviceID := authMessage.DeviceID
+	if deviceID == "" {
+		deviceID = uuid.NewString()
+	}
+
+	if authMessage.V < 0 || authMessage.V > protocolVersion {
+		log.Println("Unsupported protocol version", authMessage.V)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "Unsupported protocol version"))
+		conn.Close()
+		return
+	}
+
+	client := NewConn(conn, username, deviceID)
+	client.CursorDevice = authMessage.DeviceID
+	client.Version = authMessage.V
+	client.SessionID = sessionID
+	client.Hold()
+	oldConn := clients.Add(client)
+	if oldConn != nil {
+		log.Println("WebSocket connection already exists for", username, "on device", deviceID)
+		oldConn.Close()
+	}
+	// version 0 clients cannot ack, so replaying to them would resend
+	// the same backlog on every connect
+	if client.Version >= 1 {
+		if err := replayMissed(client); err != nil {
+			log.Println("Error replaying missed messages for", username, err)
+		}
+	}
+	client.Release()
+
+	sendPresenceSnapshot(client)
+	if oldConn == nil && len(clients.Devices(username)) == 1 {
+		announcePresence(username, PresenceOnline)
 	}
-	clients[username] = conn
-	clientsMu.Unlock()
-	go HandleConnection(username, conn)
+	readLoops.Add(1)
+	go func() {
+		defer readLoops.Done()
+		HandleConnection(client)
+	}()
 }
 
 // ***********************************************
-func HandleConnection(username string, conn *websocket.Conn) {
-	defer closeConnection(conn)
+// HandleConnection is the read loop of one device. Writes never happen
+// here directly; they are queued on the recipients' Conns.
+func HandleConnection(conn *Conn) {
 	defer func() {
-		clientsMu.Lock()
-		delete(clients, username)
-		clientsMu.Unlock()
+		clients.Remove(conn)
+		conn.Close()
+		if !clients.Connected(conn.Username) {
+			announcePresence(conn.Username, PresenceOffline)
+		}
+		// the session was in use until the socket closed
+		touchSession(conn.SessionID)
 	}()
 
-	conn.SetPongHandler(func(appData string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.ws.SetReadDeadline(time.Now().Add(pongWait))
+	conn.ws.SetPongHandler(func(appData string) error {
+		conn.ws.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
-	pingTicker := time.NewTicker(50 * time.Second)
-	defer pingTicker.Stop()
-
-	go func() {
-		for range pingTicker.C {
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Println("write ping:", err)
-				return
-			}
-		}
-	}()
-
 	for {
-		messageType, p, err := conn.ReadMessage()
+		_, p, err := conn.ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				log.Println("connection closed:", err)
-				break
 			} else {
 				log.Println("ReadMessage:", err)
 			}
-			closeConnection(conn)
 			return
 		}
-		var receivedMessage Message
-		if err := json.Unmarshal(p, &receivedMessage); err != nil {
-			log.Println("Unmarshal", err)
-		}
 
-		if receivedMessage.Timestamp == nil {
-			now := time.Now()
-			receivedMessage.Timestamp = &now
-		}
-		if receivedMessage.ID == "" {
-			receivedMessage.ID = uuid.NewString()
-		}
+		dispatchFrame(conn, p)
+	}
+}
 
-		forwardMessage := Message{
-			ID:        receivedMessage.ID,
-			ConvID:    receivedMessage.ConvID,
-			To:        receivedMessage.To,
-			From:      receivedMessage.From,
-			Content:   receivedMessage.Content,
-			Timestamp: receivedMessage.Timestamp,
-		}
+// ***********************************************
+// handleSend stores a message from conn's user and fans it out to every
+// device of every participant. A message without an id takes the id of
+// its frame.
+func handleSend(conn *Conn, env Envelope) {
+	username := conn.Username
+
+	var receivedMessage Message
+	if !decodePayload(conn, env, &receivedMessage) {
+		return
+	}
+	if receivedMessage.ID == "" {
+		receivedMessage.ID = env.ID
+	}
+	// errors go back under the frame's id, or for version 0 clients,
+	// which have no frame id, under the message's
+	correlationID := env.ID
+	if correlationID == "" {
+		correlationID = receivedMessage.ID
+	}
 
-		forwardMessageBytes, err := json.Marshal(forwardMessage)
-		if err != nil {
-			log.Println("Marshal", err)
-		}
+	conversation, err := authorizeConversation(username, receivedMessage.ConvID)
+	if err != nil {
+		log.Println(username, "cannot post to conversation", receivedMessage.ConvID, err)
+		sendError(conn, correlationID, "not_found", "conversation not found")
+		return
+	}
+	// To is optional now that every participant gets the message,
+	// but if a client names a recipient it has to be in the conversation
+	if _, ok := conversation.Participants[receivedMessage.To]; receivedMessage.To != "" && !ok {
+		sendError(conn, correlationID, "invalid_recipient", "recipient is not a participant")
+		return
+	}
+	// the connection is authenticated, whatever the client claims
+	receivedMessage.From = username
+
+	// history is ordered by the server's clock, never the client's
+	now := nextMessageTimestamp()
+	receivedMessage.Timestamp = &now
+	if receivedMessage.ID == "" {
+		receivedMessage.ID = uuid.NewString()
+	}
 
-		clientsMu.RLock()
-		recipientConn, recipientExists := clients[receivedMessage.To]
-		senderConn, senderExists := clients[receivedMessage.From]
-		clientsMu.RUnlock()
-		// TODO: should probably store the message in the database
-		// before sending it to the users
-		if senderExists {
-			senderConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := senderConn.WriteMessage(messageType, forwardMessageBytes); err != nil {
-				log.Println("Error writing message to echo connection:", err)
-				closeConnection(senderConn)
-				clientsMu.Lock()
-				delete(clients, receivedMessage.From)
-				clientsMu.Unlock()
-			}
-		} else {
-			log.Println(receivedMessage.From, "is not logged in")
-		}
-		if recipientExists {
-			recipientConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := recipientConn.WriteMessage(messageType, forwardMessageBytes); err != nil {
-				log.Println("Error writng message to recipient connection:", err)
-				closeConnection(recipientConn)
-				clientsMu.Lock()
-				delete(clients, receivedMessage.To)
-				clientsMu.Unlock()
-			}
-		} else {
-			log.Println(receivedMessage.To, "is not logged in")
-		}
-		if err := db.AddMessageToConversation(forwardMessage); err != nil {
-			utils.HandleDatabaseError(err)
-		}
+	forwardMessage := Message{
+		ID:        receivedMessage.ID,
+		ConvID:    receivedMessage.ConvID,
+		To:        receivedMessage.To,
+		From:      receivedMessage.From,
+		Content:   receivedMessage.Content,
+		Timestamp: receivedMessage.Timestamp,
+	}
+
+	// store before fanning out so a device that is replaying its
+	// backlog right now finds the message in one place or the other
+	err = db.AddMessageToConversation(forwardMessage)
+	if err == ErrDuplicate {
+		sendError(conn, correlationID, "duplicate_id", "a message with this id already exists")
+		return
 	}
+	if err != nil {
+		utils.HandleDatabaseError(err)
+		sendError(conn, correlationID, "internal", "could not store message")
+		return
+	}
+
+	// Content is a single ciphertext under the conversation's
+	// symmetric key, so every device of every participant gets the
+	// same frame. That includes the sender's other devices, and the
+	// sending device itself, which learns the server assigned id and
+	// timestamp from it. Offline participants catch up from their
+	// delivery cursor when they reconnect.
+	broadcast(participantNames(conversation, ""), FrameMessage, forwardMessage.ID, forwardMessage)
 }
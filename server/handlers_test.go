@@ -3,33 +3,84 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joemafrici/argo/utils"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // ***********************************************
-func setupTestDB(t *testing.T) (*DBClient, func()) {
-	dbName := "testdb_" + time.Now().Format("2006012150405")
+func TestMain(m *testing.M) {
+	if os.Getenv("JWT_SECRET") == "" {
+		if err := utils.LoadSecret(); err != nil {
+			os.Setenv("JWT_SECRET", "argo-test-secret")
+		}
+	}
+	if err := utils.LoadKeyring(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	utils.CheckSession = checkSession
+	os.Exit(m.Run())
+}
+
+// ***********************************************
+func waitForReadLoops(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		readLoops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connections from an earlier test are still open")
+	}
+}
 
-	mongoURI := os.Getenv("MONGODB_URI")
+// ***********************************************
+// setupTestDB swaps the package level store for a fresh one. Tests run
+// against the in-memory store unless ARGO_TEST_MONGODB_URI points at a
+// MongoDB instance, in which case a throwaway database is used.
+func setupTestDB(t *testing.T) (Store, func()) {
+	// read loops left over from the previous test still use the store
+	waitForReadLoops(t)
+	limiter = NewLoginLimiter(NewMemoryAttempts())
+
+	mongoURI := os.Getenv("ARGO_TEST_MONGODB_URI")
 	if mongoURI == "" {
-		mongoURI = "mongodb://mongo:27017/argodb"
+		testDB := NewMemoryStore()
+		db = testDB
+		return testDB, func() {}
 	}
 
+	dbName := "testdb_" + time.Now().Format("2006012150405")
+
 	ctx := context.TODO()
 	opts := options.Client().ApplyURI(mongoURI)
 	client, err := mongo.Connect(ctx, opts)
@@ -46,6 +97,9 @@ func setupTestDB(t *testing.T) (*DBClient, func()) {
 		client: client,
 		name:   dbName,
 	}
+	if err := testDB.EnsureIndexes(); err != nil {
+		t.Fatalf("Failed to create indexes: %v", err)
+	}
 
 	// replace production database with test database
 	db = testDB
@@ -64,17 +118,38 @@ func setupTestDB(t *testing.T) (*DBClient, func()) {
 	return testDB, cleanup
 }
 
+// ***********************************************
+// testKeys returns key fields that pass registration: a base64 SPKI
+// public key, a wrapped private key and a salt.
+func testKeys(t *testing.T) (string, string, string) {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	wrapped := make([]byte, 64)
+	salt := make([]byte, 16)
+	rand.Read(wrapped)
+	rand.Read(salt)
+	return base64.StdEncoding.EncodeToString(spki), base64.StdEncoding.EncodeToString(wrapped), base64.StdEncoding.EncodeToString(salt)
+}
+
 // ***********************************************
 func TestHandleRegister(t *testing.T) {
 	testDB, cleanup := setupTestDB(t)
 	defer cleanup()
 
+	publicKey, encryptedPrivateKey, salt := testKeys(t)
 	newUser := User{
 		Username:            "testuser",
 		Password:            "testpassword",
-		PublicKey:           "testpublickey",
-		EncryptedPrivateKey: "testencryptedprivatekey",
-		SaltBase64:          "testsalt",
+		PublicKey:           publicKey,
+		EncryptedPrivateKey: encryptedPrivateKey,
+		SaltBase64:          salt,
 	}
 
 	requestBody, _ := json.Marshal(newUser)
@@ -88,13 +163,7 @@ func TestHandleRegister(t *testing.T) {
 		t.Errorf("expected status %v; got %v", http.StatusCreated, result.StatusCode)
 	}
 
-	var resultUser User
-	filter := bson.M{
-		"username": newUser.Username,
-	}
-	ctx := context.TODO()
-	coll := testDB.client.Database(testDB.name).Collection("users")
-	err := coll.FindOne(ctx, filter).Decode(&resultUser)
+	resultUser, err := testDB.FindUserByUsername(newUser.Username)
 	if err != nil {
 		t.Errorf("Failed to find created user: %v", err)
 	}
@@ -105,14 +174,230 @@ func TestHandleRegister(t *testing.T) {
 }
 
 // ***********************************************
-func TestHandleLogin(t *testing.T) {
+func TestRegisterValidation(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	publicKey, encryptedPrivateKey, salt := testKeys(t)
+	valid := func() map[string]string {
+		return map[string]string{
+			"username":            "testuser",
+			"password":            "correct horse",
+			"publicKey":           publicKey,
+			"encryptedPrivateKey": encryptedPrivateKey,
+			"saltBase64":          salt,
+		}
+	}
+	register := func(body map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request, _ := http.NewRequest("POST", "/api/register", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleRegister(responseRecorder, request)
+		return responseRecorder
+	}
+
+	/////////////////////////////////////////////////
+	// each bad field is reported by name
+	/////////////////////////////////////////////////
+	tests := []struct {
+		name  string
+		field string
+		value string
+		code  string
+	}{
+		{"short username", "username", "ab", "length"},
+		{"long username", "username", strings.Repeat("a", 33), "length"},
+		{"dotted username", "username", "test.user", "charset"},
+		{"operator username", "username", "$where", "charset"},
+		{"unicode username", "username", "tëstuser", "charset"},
+		{"leading dash", "username", "-testuser", "charset"},
+		{"short password", "password", "short", "too_short"},
+		{"repetitive password", "password", "aaaaaaaaaaaa", "too_simple"},
+		{"password with username", "password", "testuser123", "contains_username"},
+		{"long password", "password", strings.Repeat("ab", 40), "too_long"},
+		{"public key not base64", "publicKey", "not a key!", "invalid_base64"},
+		{"public key not SPKI", "publicKey", base64.StdEncoding.EncodeToString([]byte("not a key")), "invalid_key"},
+		{"public key bad JWK", "publicKey", `{"x": "y"}`, "invalid_jwk"},
+		{"short private key", "encryptedPrivateKey", base64.StdEncoding.EncodeToString([]byte("short")), "too_short"},
+		{"salt not base64", "saltBase64", "salt!", "invalid_base64"},
+		{"short salt", "saltBase64", base64.StdEncoding.EncodeToString([]byte("salt")), "too_short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := valid()
+			body[tt.field] = tt.value
+			responseRecorder := register(body)
+			if responseRecorder.Code != http.StatusBadRequest {
+				t.Fatalf("got status %v; want %v", responseRecorder.Code, http.StatusBadRequest)
+			}
+			var response struct {
+				Error  string       `json:"error"`
+				Fields []FieldError `json:"fields"`
+			}
+			if err := json.NewDecoder(responseRecorder.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if response.Error != "validation_failed" || len(response.Fields) != 1 {
+				t.Fatalf("unexpected response: %+v", response)
+			}
+			if response.Fields[0].Field != tt.field || response.Fields[0].Code != tt.code {
+				t.Errorf("got %+v; want %s %s", response.Fields[0], tt.field, tt.code)
+			}
+		})
+	}
+
+	/////////////////////////////////////////////////
+	// a body that is not JSON and a recovery key without a verifier
+	// get the same structured errors
+	/////////////////////////////////////////////////
+	request, _ := http.NewRequest("POST", "/api/register", strings.NewReader("{"))
+	responseRecorder := httptest.NewRecorder()
+	HandleRegister(responseRecorder, request)
+	var response struct {
+		Error  string       `json:"error"`
+		Fields []FieldError `json:"fields"`
+	}
+	json.NewDecoder(responseRecorder.Body).Decode(&response)
+	if responseRecorder.Code != http.StatusBadRequest || response.Error != "validation_failed" || len(response.Fields) != 1 || response.Fields[0].Field != "body" {
+		t.Errorf("malformed body: got status %v %+v", responseRecorder.Code, response)
+	}
+	body := valid()
+	body["recoveryEncryptedPrivateKey"] = encryptedPrivateKey
+	responseRecorder = register(body)
+	response.Fields = nil
+	json.NewDecoder(responseRecorder.Body).Decode(&response)
+	if responseRecorder.Code != http.StatusBadRequest || len(response.Fields) != 1 || response.Fields[0].Field != "recoveryVerifier" {
+		t.Errorf("recovery key without a verifier: got status %v %+v", responseRecorder.Code, response)
+	}
+
+	/////////////////////////////////////////////////
+	// a JWK public key is accepted
+	/////////////////////////////////////////////////
+	body = valid()
+	body["username"] = "jwkuser"
+	body["publicKey"] = `{"kty": "RSA", "n": "AQAB", "e": "AQAB"}`
+	if code := register(body).Code; code != http.StatusCreated {
+		t.Errorf("JWK public key: got status %v; want %v", code, http.StatusCreated)
+	}
+
+	/////////////////////////////////////////////////
+	// usernames are case-insensitive
+	/////////////////////////////////////////////////
+	body = valid()
+	body["username"] = "  TestUser "
+	if code := register(body).Code; code != http.StatusCreated {
+		t.Fatalf("register: got status %v", code)
+	}
+	if _, err := testDB.FindUserByUsername("testuser"); err != nil {
+		t.Errorf("username was not normalized: %v", err)
+	}
+	body["username"] = "TESTUSER"
+	if code := register(body).Code; code != http.StatusConflict {
+		t.Errorf("same name in other case: got status %v; want %v", code, http.StatusConflict)
+	}
+
+	login := func(username string) LoginResponse {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": username, "password": "correct horse"})
+		request, _ := http.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		if responseRecorder.Code != http.StatusOK {
+			t.Fatalf("login as %s: got status %v; want %v", username, responseRecorder.Code, http.StatusOK)
+		}
+		var loginResponse LoginResponse
+		json.NewDecoder(responseRecorder.Body).Decode(&loginResponse)
+		return loginResponse
+	}
+	login("TestUser")
+
+	/////////////////////////////////////////////////
+	// an account made before names were normalized keeps its name,
+	// nobody can take it in another case
+	/////////////////////////////////////////////////
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err := testDB.CreateUser(User{Username: "Alice", Password: string(hashedPassword)}); err != nil {
+		t.Fatalf("Failed to insert legacy user: %v", err)
+	}
+	body = valid()
+	body["username"] = "alice"
+	if code := register(body).Code; code != http.StatusConflict {
+		t.Errorf("lowercase copy of a legacy name: got status %v; want %v", code, http.StatusConflict)
+	}
+	for _, username := range []string{"Alice", "alice"} {
+		owner, err := utils.ValidateTokenFromString(login(username).Token)
+		if err != nil || owner != "Alice" {
+			t.Errorf("login as %s got the token of %q %v", username, owner, err)
+		}
+	}
+	if err := testDB.SetTOTP("alice", &TOTP{Secret: "secret"}); err != nil {
+		t.Errorf("Failed to update a legacy user by its lowercase name: %v", err)
+	}
+	if err := testDB.DeleteUser("alice"); err != nil {
+		t.Errorf("Failed to delete a legacy user by its lowercase name: %v", err)
+	}
+	if _, err := testDB.FindUserByUsername("Alice"); err != ErrNotFound {
+		t.Errorf("legacy user was not deleted: %v", err)
+	}
+}
+
+// ***********************************************
+func TestConcurrentRegister(t *testing.T) {
 	testDB, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	errSecret := utils.LoadSecret()
-	if errSecret != nil {
-		t.Fatalf("Failed to load JWT secret: %v", errSecret)
+	publicKey, encryptedPrivateKey, salt := testKeys(t)
+	requestBody, _ := json.Marshal(map[string]string{
+		"username":            "testuser",
+		"password":            "correct horse",
+		"publicKey":           publicKey,
+		"encryptedPrivateKey": encryptedPrivateKey,
+		"saltBase64":          salt,
+	})
+
+	/////////////////////////////////////////////////
+	// racing registrations for one name make one user
+	/////////////////////////////////////////////////
+	const attempts = 5
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, _ := http.NewRequest("POST", "/api/register", bytes.NewBuffer(requestBody))
+			responseRecorder := httptest.NewRecorder()
+			HandleRegister(responseRecorder, request)
+			codes <- responseRecorder.Code
+		}()
 	}
+	wg.Wait()
+	close(codes)
+
+	created, conflicts := 0, 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("unexpected status %v", code)
+		}
+	}
+	if created != 1 || conflicts != attempts-1 {
+		t.Errorf("got %d created and %d conflicts; want 1 and %d", created, conflicts, attempts-1)
+	}
+	if _, err := testDB.FindUserByUsername("testuser"); err != nil {
+		t.Errorf("Failed to find created user: %v", err)
+	}
+}
+
+// ***********************************************
+func TestHandleLogin(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
 
 	/////////////////////////////////////////////////
 	// test login success
@@ -129,9 +414,7 @@ func TestHandleLogin(t *testing.T) {
 		SaltBase64:          "testsalt",
 	}
 
-	ctx := context.TODO()
-	coll := testDB.client.Database(testDB.name).Collection("users")
-	_, err := coll.InsertOne(ctx, testUser)
+	err := testDB.CreateUser(testUser)
 	if err != nil {
 		t.Fatalf("Failed to insert test user: %v", err)
 	}
@@ -165,6 +448,9 @@ func TestHandleLogin(t *testing.T) {
 	if loginResponse.Token == "" {
 		t.Errorf("No token returned in login response")
 	}
+	if loginResponse.RefreshToken == "" || loginResponse.ExpiresIn <= 0 {
+		t.Errorf("No refresh token returned in login response: %+v", loginResponse.TokenResponse)
+	}
 
 	if loginResponse.Keys.Public != testUser.PublicKey {
 		t.Errorf("Incorrect public key returned: got %v want %v", loginResponse.Keys.Public,
@@ -214,12 +500,377 @@ func TestHandleLogin(t *testing.T) {
 }
 
 // ***********************************************
-func TestHandleCreateConversation(t *testing.T) {
+func TestLoginRateLimit(t *testing.T) {
 	testDB, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	ctx := context.TODO()
-	usersColl := testDB.client.Database(testDB.name).Collection("users")
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.MinCost)
+	for _, username := range []string{"victim", "neighbour", "regular", "padded"} {
+		if err := testDB.CreateUser(User{Username: username, Password: string(hashedPassword)}); err != nil {
+			t.Fatalf("Failed to insert test user: %v", err)
+		}
+	}
+
+	login := func(username, password, ip string) *httptest.ResponseRecorder {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		request := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		request.RemoteAddr = ip + ":40000"
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		return responseRecorder
+	}
+	retryAfter := func(responseRecorder *httptest.ResponseRecorder) int {
+		t.Helper()
+		if responseRecorder.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status %v; got %v", http.StatusTooManyRequests, responseRecorder.Code)
+		}
+		seconds, err := strconv.Atoi(responseRecorder.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatalf("bad Retry-After header: %v", err)
+		}
+		return seconds
+	}
+
+	/////////////////////////////////////////////////
+	// a few mistakes are free, then the username has to back off
+	/////////////////////////////////////////////////
+	for i := 0; i < usernamePolicy.Free; i++ {
+		if code := login("victim", "wrong", "198.51.100.1").Code; code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %v; want %v", i, code, http.StatusUnauthorized)
+		}
+	}
+	if seconds := retryAfter(login("Victim", "testpassword", "198.51.100.2")); seconds != 1 {
+		t.Errorf("expected to retry after 1 second, got %d", seconds)
+	}
+	if code := login("neighbour", "testpassword", "198.51.100.1").Code; code != http.StatusOK {
+		t.Errorf("another user from the same address: got status %v; want %v", code, http.StatusOK)
+	}
+
+	/////////////////////////////////////////////////
+	// the delay doubles until the account is locked out
+	/////////////////////////////////////////////////
+	now := time.Now()
+	if wait := limiter.Wait("victim", "198.51.100.3", now); wait <= 0 || wait > usernamePolicy.Base {
+		t.Errorf("unexpected wait after %d failures: %v", usernamePolicy.Free, wait)
+	}
+	limiter.Fail("victim", "198.51.100.3", now)
+	if wait := limiter.Wait("victim", "198.51.100.3", now); wait != 2*usernamePolicy.Base {
+		t.Errorf("expected the delay to double, got %v", wait)
+	}
+	for i := usernamePolicy.Free + 1; i < usernamePolicy.Threshold; i++ {
+		limiter.Fail("victim", "198.51.100.3", now)
+	}
+	if seconds := retryAfter(login("victim", "testpassword", "198.51.100.4")); seconds < int(usernamePolicy.Lockout.Seconds())-5 {
+		t.Errorf("expected a lockout, got a retry after %d seconds", seconds)
+	}
+	if wait := limiter.Wait("victim", "198.51.100.4", now.Add(usernamePolicy.Window+time.Minute)); wait != 0 {
+		t.Errorf("failures outlived their window: %v", wait)
+	}
+
+	/////////////////////////////////////////////////
+	// one address guessing at many usernames is limited too
+	/////////////////////////////////////////////////
+	for i := 0; i < ipPolicy.Free; i++ {
+		login(fmt.Sprintf("guess%d", i), "wrong", "192.0.2.9")
+	}
+	retryAfter(login("regular", "testpassword", "192.0.2.9"))
+
+	/////////////////////////////////////////////////
+	// spelling the username differently does not start a new count
+	/////////////////////////////////////////////////
+	variants := []string{"padded ", " PADDED", "Padded  ", "\tpadded"}
+	for i := 0; i < usernamePolicy.Free; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", 20+i)
+		if code := login(variants[i%len(variants)], "wrong", ip).Code; code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %v; want %v", i, code, http.StatusUnauthorized)
+		}
+	}
+	retryAfter(login("padded", "testpassword", "198.51.100.30"))
+	now = time.Now()
+	for i := usernamePolicy.Free; i < usernamePolicy.Threshold; i++ {
+		limiter.Fail(variants[i%len(variants)], fmt.Sprintf("198.51.100.%d", 20+i), now)
+	}
+	if seconds := retryAfter(login("  padded ", "testpassword", "198.51.100.31")); seconds < int(usernamePolicy.Lockout.Seconds())-5 {
+		t.Errorf("expected a lockout, got a retry after %d seconds", seconds)
+	}
+
+	/////////////////////////////////////////////////
+	// X-Real-IP only counts from a trusted proxy
+	/////////////////////////////////////////////////
+	spoofed := httptest.NewRequest("POST", "/api/login", nil)
+	spoofed.RemoteAddr = "192.0.2.9:40000"
+	spoofed.Header.Set("X-Real-IP", "198.51.100.99")
+	if ip := clientIP(spoofed); ip != "192.0.2.9" {
+		t.Errorf("untrusted X-Real-IP was believed: %s", ip)
+	}
+	proxies, err := parseTrustedProxies("10.0.0.1, 192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+	if ip := clientIP(spoofed); ip != "198.51.100.99" {
+		t.Errorf("X-Real-IP from a trusted proxy was ignored: %s", ip)
+	}
+	if _, err := parseTrustedProxies("nginx"); err == nil {
+		t.Errorf("expected an error for an invalid proxy")
+	}
+
+	/////////////////////////////////////////////////
+	// logging in clears the username's failures
+	/////////////////////////////////////////////////
+	for round := 0; round < 2; round++ {
+		for i := 0; i < usernamePolicy.Free-1; i++ {
+			login("regular", "wrong", "198.51.100.5")
+		}
+		if code := login("regular", "testpassword", "198.51.100.5").Code; code != http.StatusOK {
+			t.Fatalf("round %d: got status %v; want %v", round, code, http.StatusOK)
+		}
+	}
+}
+
+// ***********************************************
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if code, err := totpCode(secret, unix/totpPeriod); err != nil || code != want {
+			t.Errorf("code at %d: got %q %v; want %q", unix, code, err, want)
+		}
+	}
+}
+
+// ***********************************************
+func TestTwoFactorLogin(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.MinCost)
+	if err := testDB.CreateUser(User{Username: "testuser", Password: string(hashedPassword)}); err != nil {
+		t.Fatalf("Failed to insert test user: %v", err)
+	}
+	token, _ := newSessionToken(t, "testuser")
+
+	post := func(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request := httptest.NewRequest("POST", "/", bytes.NewBuffer(requestBody))
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		handler(responseRecorder, request)
+		return responseRecorder
+	}
+	login := func() TwoFactorChallenge {
+		t.Helper()
+		responseRecorder := post(HandleLogin, map[string]string{"username": "testuser", "password": "testpassword"})
+		var challenge TwoFactorChallenge
+		json.NewDecoder(responseRecorder.Body).Decode(&challenge)
+		return challenge
+	}
+	secondStep := func(body map[string]string) (TokenResponse, int) {
+		t.Helper()
+		responseRecorder := post(HandleLoginTOTP, body)
+		var loginResponse LoginResponse
+		if responseRecorder.Code == http.StatusOK {
+			json.NewDecoder(responseRecorder.Body).Decode(&loginResponse)
+		}
+		return loginResponse.TokenResponse, responseRecorder.Code
+	}
+
+	/////////////////////////////////////////////////
+	// enrolling takes the password and needs a code from the app
+	// before it is enabled
+	/////////////////////////////////////////////////
+	if code := post(protectedEndpoint(HandleTOTPEnroll), map[string]string{"password": "wrong"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("enroll with a wrong password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	responseRecorder := post(protectedEndpoint(HandleTOTPEnroll), map[string]string{"password": "testpassword"})
+	var enrollment TOTPEnrollment
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&enrollment); err != nil {
+		t.Fatalf("Failed to decode enrollment: %v", err)
+	}
+	uri, err := url.Parse(enrollment.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Query().Get("secret") != enrollment.Secret || uri.Query().Get("issuer") != totpIssuer {
+		t.Fatalf("unexpected provisioning uri %q", enrollment.URI)
+	}
+	if challenge := login(); challenge.TwoFactorRequired {
+		t.Fatalf("login asked for a code before enrollment was verified")
+	}
+	if code := post(protectedEndpoint(HandleTOTPVerify), map[string]string{"code": "000000"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("verify with a wrong code: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	step := time.Now().Unix() / totpPeriod
+	current, _ := totpCode(enrollment.Secret, step)
+	responseRecorder = post(protectedEndpoint(HandleTOTPVerify), map[string]string{"code": current})
+	var recovery RecoveryCodesResponse
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&recovery); err != nil || len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v %v", recoveryCodeCount, recovery.RecoveryCodes, err)
+	}
+
+	/////////////////////////////////////////////////
+	// a password alone now only gets a challenge
+	/////////////////////////////////////////////////
+	challenge := login()
+	if !challenge.TwoFactorRequired || challenge.ChallengeToken == "" {
+		t.Fatalf("expected a two-factor challenge, got %+v", challenge)
+	}
+	if _, err := utils.ValidateTokenFromString(challenge.ChallengeToken); err == nil {
+		t.Errorf("challenge token was accepted as an access token")
+	}
+	if _, code := secondStep(map[string]string{"challengeToken": token, "code": current}); code != http.StatusUnauthorized {
+		t.Errorf("access token used as a challenge: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+
+	/////////////////////////////////////////////////
+	// every code works once
+	/////////////////////////////////////////////////
+	if _, code := secondStep(map[string]string{"challengeToken": challenge.ChallengeToken, "code": current}); code != http.StatusUnauthorized {
+		t.Errorf("code used to enroll: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	next, _ := totpCode(enrollment.Secret, step+1)
+	tokens, code := secondStep(map[string]string{"challengeToken": challenge.ChallengeToken, "code": next})
+	if code != http.StatusOK || tokens.Token == "" {
+		t.Fatalf("second step: got status %v", code)
+	}
+	if _, code := secondStep(map[string]string{"challengeToken": challenge.ChallengeToken, "code": next}); code != http.StatusUnauthorized {
+		t.Errorf("replayed code: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	recoveryCode := strings.ToUpper(recovery.RecoveryCodes[0])
+	if _, code := secondStep(map[string]string{"challengeToken": challenge.ChallengeToken, "recoveryCode": recoveryCode}); code != http.StatusOK {
+		t.Errorf("recovery code: got status %v; want %v", code, http.StatusOK)
+	}
+	if _, code := secondStep(map[string]string{"challengeToken": challenge.ChallengeToken, "recoveryCode": recoveryCode}); code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+
+	/////////////////////////////////////////////////
+	// turning it off takes the password and a second factor
+	/////////////////////////////////////////////////
+	if code := post(protectedEndpoint(HandleTOTPDisable), map[string]string{"password": "testpassword"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("disable without a code: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	disable := map[string]string{"password": "testpassword", "recoveryCode": recovery.RecoveryCodes[1]}
+	if code := post(protectedEndpoint(HandleTOTPDisable), disable).Code; code != http.StatusOK {
+		t.Fatalf("disable: got status %v", code)
+	}
+	if challenge := login(); challenge.TwoFactorRequired {
+		t.Errorf("login still asks for a code after disabling")
+	}
+
+	/////////////////////////////////////////////////
+	// guessing through these endpoints is throttled like logging in
+	/////////////////////////////////////////////////
+	for i := 0; i < usernamePolicy.Free; i++ {
+		post(protectedEndpoint(HandleTOTPDisable), map[string]string{"password": "wrong"})
+	}
+	if code := post(protectedEndpoint(HandleTOTPDisable), map[string]string{"password": "testpassword"}).Code; code != http.StatusTooManyRequests {
+		t.Errorf("disable after repeated failures: got status %v; want %v", code, http.StatusTooManyRequests)
+	}
+}
+
+// ***********************************************
+func TestHandleRefresh(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	if err := testDB.CreateUser(User{Username: "testuser", Password: string(hashedPassword)}); err != nil {
+		t.Fatalf("Failed to insert test user: %v", err)
+	}
+
+	login := func() TokenResponse {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": "testuser", "password": "testpassword"})
+		request, _ := http.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		var loginResponse LoginResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&loginResponse); err != nil {
+			t.Fatalf("Failed to decode login response: %v", err)
+		}
+		return loginResponse.TokenResponse
+	}
+	refresh := func(refreshToken string) (TokenResponse, int) {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"refreshToken": refreshToken})
+		request, _ := http.NewRequest("POST", "/api/refresh", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleRefresh(responseRecorder, request)
+		var tokens TokenResponse
+		if responseRecorder.Code == http.StatusOK {
+			if err := json.NewDecoder(responseRecorder.Body).Decode(&tokens); err != nil {
+				t.Fatalf("Failed to decode refresh response: %v", err)
+			}
+		}
+		return tokens, responseRecorder.Code
+	}
+
+	/////////////////////////////////////////////////
+	// refresh tokens rotate on every use
+	/////////////////////////////////////////////////
+	first := login()
+	second, code := refresh(first.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh: got status %v", code)
+	}
+	if second.Token == "" || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh did not rotate the tokens: %+v", second)
+	}
+	if username, err := utils.ValidateTokenFromString(second.Token); err != nil || username != "testuser" {
+		t.Errorf("refreshed access token is not valid: %v %v", username, err)
+	}
+	third, code := refresh(second.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("second refresh: got status %v", code)
+	}
+
+	/////////////////////////////////////////////////
+	// reusing a refresh token revokes its whole family, but not the
+	// families of other logins
+	/////////////////////////////////////////////////
+	other := login()
+	if _, code := refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	if _, code := refresh(third.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh token of a revoked family: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	if _, code := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("refresh token of another login: got status %v; want %v", code, http.StatusOK)
+	}
+
+	/////////////////////////////////////////////////
+	// unknown and expired tokens are rejected
+	/////////////////////////////////////////////////
+	if _, code := refresh("not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("unknown refresh token: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	issued := time.Now().Add(-2 * refreshTokenTTL)
+	expired := RefreshToken{
+		Hash:      hashRefreshToken("expired"),
+		Family:    uuid.NewString(),
+		Username:  "testuser",
+		IssuedAt:  issued,
+		ExpiresAt: issued.Add(refreshTokenTTL),
+	}
+	if err := testDB.CreateRefreshToken(expired); err != nil {
+		t.Fatalf("Failed to insert refresh token: %v", err)
+	}
+	if _, code := refresh("expired"); code != http.StatusUnauthorized {
+		t.Errorf("expired refresh token: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+}
+
+// ***********************************************
+func TestHandleCreateConversation(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
 
 	/////////////////////////////////////////////////
 	// test create conversation success
@@ -231,7 +882,7 @@ func TestHandleCreateConversation(t *testing.T) {
 	}
 
 	for _, user := range testUsers {
-		_, err := usersColl.InsertOne(ctx, user)
+		err := testDB.CreateUser(user)
 		if err != nil {
 			t.Fatalf("Failed to insert test user: %v", err)
 		}
@@ -257,7 +908,7 @@ func TestHandleCreateConversation(t *testing.T) {
 
 	responseRecorder := httptest.NewRecorder()
 
-	ctx = context.WithValue(request.Context(), "username", "user1")
+	ctx := context.WithValue(request.Context(), "username", "user1")
 	request = request.WithContext(ctx)
 
 	HandleCreateConversation(responseRecorder, request)
@@ -287,13 +938,7 @@ func TestHandleCreateConversation(t *testing.T) {
 		}
 	}
 
-	var dbConversation Conversation
-	conversationColl := testDB.client.Database(testDB.name).Collection("conversations")
-	ctx = context.TODO()
-	filter := bson.M{
-		"id": conversationResponse.ID,
-	}
-	err = conversationColl.FindOne(ctx, filter).Decode(&dbConversation)
+	dbConversation, err := testDB.GetUserConversation("user1", conversationResponse.ID)
 	if err != nil {
 		t.Fatalf("Failed to find conversation in database: %v", err)
 	}
@@ -324,6 +969,32 @@ func TestHandleCreateConversation(t *testing.T) {
 		t.Errorf("expected status %v; got %v", http.StatusBadRequest, result.StatusCode)
 	}
 
+	/////////////////////////////////////////////////
+	// participants are found whatever the case of their name
+	/////////////////////////////////////////////////
+	createConversationRequest.Participants = createConversationRequest.Participants[:2]
+	createConversationRequest.Participants[0].Username = "User1"
+	createConversationRequest.Participants[1].Username = "USER2"
+
+	requestBody, _ = json.Marshal(createConversationRequest)
+	request, _ = http.NewRequest("POST", "/api/create-conversation", bytes.NewBuffer(requestBody))
+	responseRecorder = httptest.NewRecorder()
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user1"))
+
+	HandleCreateConversation(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf("mixed case participants: got status %v; want %v", responseRecorder.Code, http.StatusOK)
+	}
+	conversationResponse = Conversation{}
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&conversationResponse); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	for _, user := range testUsers {
+		if _, ok := conversationResponse.Participants[user.Username]; !ok {
+			t.Errorf("Participant %s not keyed by the stored name: %+v", user.Username, conversationResponse.Participants)
+		}
+	}
 }
 
 // ***********************************************
@@ -337,10 +1008,8 @@ func TestHandleGetUserConversations(t *testing.T) {
 		{Username: "user3", PublicKey: "publicKey3"},
 	}
 
-	ctx := context.TODO()
-	usersColl := testDB.client.Database(testDB.name).Collection("users")
 	for _, user := range testUsers {
-		_, err := usersColl.InsertOne(ctx, user)
+		err := testDB.CreateUser(user)
 		if err != nil {
 			t.Errorf("Failed to insert user into database: %v", err)
 		}
@@ -363,9 +1032,8 @@ func TestHandleGetUserConversations(t *testing.T) {
 		},
 	}
 
-	conversationsColl := testDB.client.Database(testDB.name).Collection("conversations")
 	for _, conv := range testConversations {
-		_, err := conversationsColl.InsertOne(ctx, conv)
+		err := testDB.CreateConversation(conv)
 		if err != nil {
 			t.Errorf("Failed to insert conversation into database: %v", err)
 		}
@@ -374,7 +1042,7 @@ func TestHandleGetUserConversations(t *testing.T) {
 	request, _ := http.NewRequest("GET", "/api/conversations", nil)
 	responseRecorder := httptest.NewRecorder()
 
-	ctx = context.WithValue(request.Context(), "username", "user1")
+	ctx := context.WithValue(request.Context(), "username", "user1")
 	request = request.WithContext(ctx)
 
 	HandleGetUserConversations(responseRecorder, request)
@@ -465,7 +1133,569 @@ func TestHandleGetUserConversations(t *testing.T) {
 }
 
 // ***********************************************
-func TestHandleWebSocket(t *testing.T) {
+func TestLogout(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	if err := testDB.CreateUser(User{Username: "testuser", Password: string(hashedPassword)}); err != nil {
+		t.Fatalf("Failed to insert test user: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	login := func() TokenResponse {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": "testuser", "password": "testpassword"})
+		request, _ := http.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		var loginResponse LoginResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&loginResponse); err != nil {
+			t.Fatalf("Failed to decode login response: %v", err)
+		}
+		return loginResponse.TokenResponse
+	}
+	post := func(handler http.HandlerFunc, token string, body interface{}) int {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request, _ := http.NewRequest("POST", "/", bytes.NewBuffer(requestBody))
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		protectedEndpoint(handler)(responseRecorder, request)
+		return responseRecorder.Code
+	}
+	expectClosed := func(ws *websocket.Conn) {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var env Envelope
+			err := ws.ReadJSON(&env)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the WebSocket to be closed, got %v", err)
+			}
+		}
+	}
+
+	phone := login()
+	laptop := login()
+	phoneWS := dialToken(t, server.URL, phone.Token, "phone", protocolVersion)
+	defer phoneWS.Close()
+	laptopWS := dialToken(t, server.URL, laptop.Token, "laptop", protocolVersion)
+	defer laptopWS.Close()
+	waitForDevices(t, "testuser", 2)
+
+	/////////////////////////////////////////////////
+	// logging out ends only the session the request was made with
+	/////////////////////////////////////////////////
+	if code := post(HandleLogout, phone.Token, nil); code != http.StatusOK {
+		t.Fatalf("logout: got status %v", code)
+	}
+	expectClosed(phoneWS)
+	if _, err := utils.ValidateTokenFromString(phone.Token); err == nil {
+		t.Errorf("access token of a logged out session is still valid")
+	}
+	if code := post(HandleLogout, phone.Token, nil); code != http.StatusUnauthorized {
+		t.Errorf("request with a logged out token: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	requestBody, _ := json.Marshal(map[string]string{"refreshToken": phone.RefreshToken})
+	request, _ := http.NewRequest("POST", "/api/refresh", bytes.NewBuffer(requestBody))
+	responseRecorder := httptest.NewRecorder()
+	HandleRefresh(responseRecorder, request)
+	if responseRecorder.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: got status %v; want %v", responseRecorder.Code, http.StatusUnauthorized)
+	}
+	if _, err := utils.ValidateTokenFromString(laptop.Token); err != nil {
+		t.Errorf("access token of another session was revoked: %v", err)
+	}
+	waitForDevices(t, "testuser", 1)
+	if _, ok := clients.Devices("testuser")["laptop"]; !ok {
+		t.Errorf("expected the laptop to stay connected")
+	}
+
+	/////////////////////////////////////////////////
+	// logging out everywhere ends every session
+	/////////////////////////////////////////////////
+	tablet := login()
+	if code := post(HandleLogoutAll, laptop.Token, nil); code != http.StatusOK {
+		t.Fatalf("logout-all: got status %v", code)
+	}
+	expectClosed(laptopWS)
+	for _, token := range []string{laptop.Token, tablet.Token} {
+		if _, err := utils.ValidateTokenFromString(token); err == nil {
+			t.Errorf("access token survived logout-all")
+		}
+	}
+	if code := post(HandleLogout, tablet.Token, nil); code != http.StatusUnauthorized {
+		t.Errorf("request after logout-all: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+}
+
+// ***********************************************
+func TestChangePassword(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("oldpassword"), bcrypt.MinCost)
+	err := testDB.CreateUser(User{
+		Username:            "testuser",
+		Password:            string(hashedPassword),
+		PublicKey:           "publicKey",
+		EncryptedPrivateKey: "wrappedWithOld",
+		SaltBase64:          "oldSalt",
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert test user: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	login := func(password string) (LoginResponse, int) {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": "testuser", "password": password})
+		request, _ := http.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		var loginResponse LoginResponse
+		if responseRecorder.Code == http.StatusOK {
+			json.NewDecoder(responseRecorder.Body).Decode(&loginResponse)
+		}
+		return loginResponse, responseRecorder.Code
+	}
+	change := func(token string, body map[string]string) int {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request, _ := http.NewRequest("POST", "/api/change-password", bytes.NewBuffer(requestBody))
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		protectedEndpoint(HandleChangePassword)(responseRecorder, request)
+		return responseRecorder.Code
+	}
+
+	phone, _ := login("oldpassword")
+	laptop, _ := login("oldpassword")
+	laptopWS := dialToken(t, server.URL, laptop.Token, "laptop", protocolVersion)
+	defer laptopWS.Close()
+	waitForDevices(t, "testuser", 1)
+
+	_, wrappedWithNew, newSalt := testKeys(t)
+	request := map[string]string{
+		"oldPassword":         "wrong",
+		"newPassword":         "newpassword",
+		"encryptedPrivateKey": wrappedWithNew,
+		"saltBase64":          newSalt,
+	}
+	if code := change(phone.Token, request); code != http.StatusUnauthorized {
+		t.Errorf("wrong old password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	request["oldPassword"] = "oldpassword"
+	if code := change(phone.Token, map[string]string{"oldPassword": "oldpassword", "newPassword": "newpassword"}); code != http.StatusBadRequest {
+		t.Errorf("without the re-wrapped key: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	malformed := map[string]string{"oldPassword": "oldpassword", "newPassword": "newpassword", "encryptedPrivateKey": "not base64!", "saltBase64": newSalt}
+	if code := change(phone.Token, malformed); code != http.StatusBadRequest {
+		t.Errorf("malformed re-wrapped key: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	if code := change(phone.Token, request); code != http.StatusOK {
+		t.Fatalf("change password: got status %v", code)
+	}
+
+	/////////////////////////////////////////////////
+	// the password and the key wrapped with it change together
+	/////////////////////////////////////////////////
+	if _, code := login("oldpassword"); code != http.StatusUnauthorized {
+		t.Errorf("old password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	loginResponse, code := login("newpassword")
+	if code != http.StatusOK {
+		t.Fatalf("new password: got status %v", code)
+	}
+	if loginResponse.Keys.EncryptedPrivate != wrappedWithNew || loginResponse.Keys.SaltBase64 != newSalt || loginResponse.Keys.Public != "publicKey" {
+		t.Errorf("unexpected keys after the change: %+v", loginResponse.Keys)
+	}
+
+	/////////////////////////////////////////////////
+	// every other session is logged out
+	/////////////////////////////////////////////////
+	waitForDevices(t, "testuser", 0)
+	if _, err := utils.ValidateTokenFromString(laptop.Token); err == nil {
+		t.Errorf("other session survived the password change")
+	}
+	if _, err := utils.ValidateTokenFromString(phone.Token); err != nil {
+		t.Errorf("the session that changed the password was logged out: %v", err)
+	}
+}
+
+// ***********************************************
+func TestAccountRecovery(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	post := func(handler http.HandlerFunc, token string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request := httptest.NewRequest("POST", "/", bytes.NewBuffer(requestBody))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		responseRecorder := httptest.NewRecorder()
+		handler(responseRecorder, request)
+		return responseRecorder
+	}
+	login := func(password string) (LoginResponse, int) {
+		t.Helper()
+		responseRecorder := post(HandleLogin, "", map[string]string{"username": "testuser", "password": password})
+		var loginResponse LoginResponse
+		if responseRecorder.Code == http.StatusOK {
+			json.NewDecoder(responseRecorder.Body).Decode(&loginResponse)
+		}
+		return loginResponse, responseRecorder.Code
+	}
+
+	/////////////////////////////////////////////////
+	// the recovery key is set up at registration
+	/////////////////////////////////////////////////
+	publicKey, encryptedPrivateKey, salt := testKeys(t)
+	_, recoveryEncryptedPrivateKey, recoverySalt := testKeys(t)
+	register := map[string]string{
+		"username":                    "testuser",
+		"password":                    "oldpassword",
+		"publicKey":                   publicKey,
+		"saltBase64":                  salt,
+		"encryptedPrivateKey":         encryptedPrivateKey,
+		"recoveryEncryptedPrivateKey": recoveryEncryptedPrivateKey,
+		"recoverySaltBase64":          recoverySalt,
+	}
+	if code := post(HandleRegister, "", register).Code; code != http.StatusBadRequest {
+		t.Errorf("recovery key without a verifier: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	register["recoveryVerifier"] = "verifier"
+	if code := post(HandleRegister, "", register).Code; code != http.StatusCreated {
+		t.Fatalf("register: got status %v", code)
+	}
+
+	/////////////////////////////////////////////////
+	// only the verifier gets the recovery copy back
+	/////////////////////////////////////////////////
+	if code := post(HandleRecoveryKey, "", map[string]string{"username": "testuser", "verifier": "wrong"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("wrong verifier: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	if code := post(HandleRecoveryKey, "", map[string]string{"username": "nobody", "verifier": "verifier"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("unknown user: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	responseRecorder := post(HandleRecoveryKey, "", map[string]string{"username": "testuser", "verifier": "verifier"})
+	var bundle RecoveryBundle
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&bundle); err != nil {
+		t.Fatalf("Failed to decode recovery bundle: %v", err)
+	}
+	if bundle.EncryptedPrivateKey != recoveryEncryptedPrivateKey || bundle.SaltBase64 != recoverySalt {
+		t.Errorf("unexpected recovery bundle: %+v", bundle)
+	}
+
+	/////////////////////////////////////////////////
+	// recovering sets a new password and logs everyone out
+	/////////////////////////////////////////////////
+	before, _ := login("oldpassword")
+	_, rewrapped, newSalt := testKeys(t)
+	recoverRequest := map[string]string{
+		"username":            "testuser",
+		"verifier":            "wrong",
+		"newPassword":         "newpassword",
+		"encryptedPrivateKey": rewrapped,
+		"saltBase64":          newSalt,
+	}
+	if code := post(HandleRecover, "", recoverRequest).Code; code != http.StatusUnauthorized {
+		t.Errorf("recover with a wrong verifier: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	recoverRequest["verifier"] = "verifier"
+	if code := post(HandleRecover, "", recoverRequest).Code; code != http.StatusOK {
+		t.Fatalf("recover: got status %v", code)
+	}
+	if _, err := utils.ValidateTokenFromString(before.Token); err == nil {
+		t.Errorf("session from before the recovery is still valid")
+	}
+	if _, code := login("oldpassword"); code != http.StatusUnauthorized {
+		t.Errorf("old password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	after, code := login("newpassword")
+	if code != http.StatusOK || after.Keys.EncryptedPrivate != rewrapped || after.Keys.SaltBase64 != newSalt {
+		t.Fatalf("login after recovery: got status %v keys %+v", code, after.Keys)
+	}
+
+	/////////////////////////////////////////////////
+	// replacing the recovery key takes the password
+	/////////////////////////////////////////////////
+	replace := map[string]string{"password": "wrong", "encryptedPrivateKey": "not base64!", "verifier": "newVerifier"}
+	if code := post(protectedEndpoint(HandleSetRecoveryKey), after.Token, replace).Code; code != http.StatusBadRequest {
+		t.Errorf("replace with a malformed key: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	_, replace["encryptedPrivateKey"], _ = testKeys(t)
+	if code := post(protectedEndpoint(HandleSetRecoveryKey), after.Token, replace).Code; code != http.StatusUnauthorized {
+		t.Errorf("replace with a wrong password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	replace["password"] = "newpassword"
+	if code := post(protectedEndpoint(HandleSetRecoveryKey), after.Token, replace).Code; code != http.StatusOK {
+		t.Fatalf("replace recovery key: got status %v", code)
+	}
+	if code := post(HandleRecoveryKey, "", map[string]string{"username": "testuser", "verifier": "verifier"}).Code; code != http.StatusUnauthorized {
+		t.Errorf("old verifier: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	if code := post(HandleRecoveryKey, "", map[string]string{"username": "testuser", "verifier": "newVerifier"}).Code; code != http.StatusOK {
+		t.Errorf("new verifier: got status %v; want %v", code, http.StatusOK)
+	}
+}
+
+// ***********************************************
+func TestSessions(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	for _, username := range []string{"testuser", "otheruser"} {
+		if err := testDB.CreateUser(User{Username: username, Password: string(hashedPassword)}); err != nil {
+			t.Fatalf("Failed to insert test user: %v", err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	login := func(username, userAgent string) TokenResponse {
+		t.Helper()
+		requestBody, _ := json.Marshal(map[string]string{"username": username, "password": "testpassword"})
+		request := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(requestBody))
+		request.Header.Set("User-Agent", userAgent)
+		request.RemoteAddr = "203.0.113.7:40000"
+		responseRecorder := httptest.NewRecorder()
+		HandleLogin(responseRecorder, request)
+		var loginResponse LoginResponse
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&loginResponse); err != nil {
+			t.Fatalf("Failed to decode login response: %v", err)
+		}
+		return loginResponse.TokenResponse
+	}
+	sessions := func(method, token string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		requestBody, _ := json.Marshal(body)
+		request, _ := http.NewRequest(method, "/api/sessions", bytes.NewBuffer(requestBody))
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		protectedEndpoint(HandleSessions)(responseRecorder, request)
+		return responseRecorder
+	}
+	list := func(token string) []SessionInfo {
+		t.Helper()
+		responseRecorder := sessions("GET", token, nil)
+		if responseRecorder.Code != http.StatusOK {
+			t.Fatalf("list sessions: got status %v", responseRecorder.Code)
+		}
+		var infos []SessionInfo
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&infos); err != nil {
+			t.Fatalf("Failed to decode sessions: %v", err)
+		}
+		return infos
+	}
+
+	phone := login("testuser", "phone-browser")
+	laptop := login("testuser", "laptop-browser")
+	other := login("otheruser", "other-browser")
+	phoneWS := dialToken(t, server.URL, phone.Token, "phone", protocolVersion)
+	defer phoneWS.Close()
+	waitForDevices(t, "testuser", 1)
+
+	/////////////////////////////////////////////////
+	// sessions are listed oldest first with where they logged in from
+	/////////////////////////////////////////////////
+	infos := list(laptop.Token)
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(infos))
+	}
+	if infos[0].UserAgent != "phone-browser" || !infos[0].Connected || infos[0].Current {
+		t.Errorf("unexpected phone session: %+v", infos[0])
+	}
+	if infos[1].UserAgent != "laptop-browser" || infos[1].Connected || !infos[1].Current {
+		t.Errorf("unexpected laptop session: %+v", infos[1])
+	}
+	if infos[0].IP != "203.0.113.7" || infos[0].CreatedAt.IsZero() || infos[0].LastSeen.IsZero() {
+		t.Errorf("session is missing its details: %+v", infos[0])
+	}
+
+	/////////////////////////////////////////////////
+	// only the user's own sessions can be revoked
+	/////////////////////////////////////////////////
+	otherID := list(other.Token)[0].ID
+	if code := sessions("DELETE", laptop.Token, map[string]string{"sessionId": otherID}).Code; code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: got status %v; want %v", code, http.StatusNotFound)
+	}
+	if _, err := utils.ValidateTokenFromString(other.Token); err != nil {
+		t.Errorf("another user's session was revoked: %v", err)
+	}
+	if code := sessions("DELETE", laptop.Token, map[string]string{}).Code; code != http.StatusBadRequest {
+		t.Errorf("revoking without a session id: got status %v; want %v", code, http.StatusBadRequest)
+	}
+
+	/////////////////////////////////////////////////
+	// revoking a session from the list logs it out
+	/////////////////////////////////////////////////
+	if code := sessions("DELETE", laptop.Token, map[string]string{"sessionId": infos[0].ID}).Code; code != http.StatusOK {
+		t.Fatalf("revoke session: got status %v", code)
+	}
+	waitForDevices(t, "testuser", 0)
+	if _, err := utils.ValidateTokenFromString(phone.Token); err == nil {
+		t.Errorf("access token of a revoked session is still valid")
+	}
+	if infos := list(laptop.Token); len(infos) != 1 || !infos[0].Current {
+		t.Errorf("expected only the current session to be listed, got %+v", infos)
+	}
+}
+
+// ***********************************************
+func TestKeyRotation(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer utils.LoadKeyring()
+
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) {
+		t.Helper()
+		data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+	}
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edPrivate)
+	writePEM("ed.pem", "PRIVATE KEY", der)
+	der, _ = x509.MarshalPKIXPublicKey(edPublic)
+	writePEM("ed.pub.pem", "PUBLIC KEY", der)
+	ecPrivate, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalECPrivateKey(ecPrivate)
+	writePEM("ec.pem", "EC PRIVATE KEY", der)
+
+	loadKeyring := func(keys ...map[string]string) {
+		t.Helper()
+		data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+		path := filepath.Join(dir, "keyring.json")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write keyring: %v", err)
+		}
+		if err := utils.LoadKeyringFile(path); err != nil {
+			t.Fatalf("Failed to load keyring: %v", err)
+		}
+	}
+	header := func(token string) map[string]interface{} {
+		t.Helper()
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			t.Fatalf("Failed to parse token: %v", err)
+		}
+		return parsed.Header
+	}
+	secret := map[string]string{"kid": "default", "alg": "HS256", "status": utils.KeyRetiring, "secret": os.Getenv("JWT_SECRET")}
+
+	/////////////////////////////////////////////////
+	// tokens signed before a rotation stay valid while their key retires
+	/////////////////////////////////////////////////
+	before, _ := newSessionToken(t, "testuser")
+	loadKeyring(
+		map[string]string{"kid": "ed", "alg": "EdDSA", "status": utils.KeyActive, "privateKeyFile": "ed.pem"},
+		secret,
+	)
+	if _, err := utils.ValidateTokenFromString(before); err != nil {
+		t.Errorf("token signed by a retiring key was rejected: %v", err)
+	}
+	after, _ := newSessionToken(t, "testuser")
+	if h := header(after); h["kid"] != "ed" || h["alg"] != "EdDSA" {
+		t.Errorf("token was not signed by the active key: %v", h)
+	}
+	if _, err := utils.ValidateTokenFromString(after); err != nil {
+		t.Errorf("token signed by the active key was rejected: %v", err)
+	}
+
+	/////////////////////////////////////////////////
+	// the public keys are published and enough to verify a token
+	/////////////////////////////////////////////////
+	responseRecorder := httptest.NewRecorder()
+	HandleJWKS(responseRecorder, httptest.NewRequest("GET", "/api/jwks", nil))
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&jwks); err != nil {
+		t.Fatalf("Failed to decode jwks: %v", err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0]["kid"] != "ed" || jwks.Keys[0]["kty"] != "OKP" {
+		t.Fatalf("expected only the Ed25519 key to be published, got %v", jwks.Keys)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["x"])
+	if _, err := jwt.Parse(after, func(*jwt.Token) (interface{}, error) { return ed25519.PublicKey(x), nil }); err != nil {
+		t.Errorf("token did not verify against the published key: %v", err)
+	}
+
+	/////////////////////////////////////////////////
+	// a token may not pick a different algorithm than its key's
+	/////////////////////////////////////////////////
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "testuser",
+		"jti":      uuid.NewString(),
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	})
+	forged.Header["kid"] = "ed"
+	forgedString, _ := forged.SignedString([]byte(edPublic))
+	if _, err := utils.ValidateTokenFromString(forgedString); err == nil {
+		t.Errorf("HS256 token was accepted for an EdDSA key")
+	}
+
+	/////////////////////////////////////////////////
+	// removed keys stop verifying; retiring keys only need a public key
+	/////////////////////////////////////////////////
+	loadKeyring(
+		map[string]string{"kid": "ec", "alg": "ES256", "status": utils.KeyActive, "privateKeyFile": "ec.pem"},
+		map[string]string{"kid": "ed", "alg": "EdDSA", "status": utils.KeyRetiring, "publicKeyFile": "ed.pub.pem"},
+	)
+	if _, err := utils.ValidateTokenFromString(before); err == nil {
+		t.Errorf("token signed by a removed key was accepted")
+	}
+	if _, err := utils.ValidateTokenFromString(after); err != nil {
+		t.Errorf("token signed by a retiring public key was rejected: %v", err)
+	}
+	latest, _ := newSessionToken(t, "testuser")
+	if h := header(latest); h["kid"] != "ec" || h["alg"] != "ES256" {
+		t.Errorf("token was not signed by the active key: %v", h)
+	}
+	if _, err := utils.ValidateTokenFromString(latest); err != nil {
+		t.Errorf("ES256 token was rejected: %v", err)
+	}
+
+	/////////////////////////////////////////////////
+	// a keyring needs exactly one active key that can sign
+	/////////////////////////////////////////////////
+	for _, keys := range [][]map[string]string{
+		{secret},
+		{{"kid": "ed", "alg": "EdDSA", "status": utils.KeyActive, "publicKeyFile": "ed.pub.pem"}},
+		{
+			{"kid": "ed", "alg": "EdDSA", "status": utils.KeyActive, "privateKeyFile": "ed.pem"},
+			{"kid": "ec", "alg": "ES256", "status": utils.KeyActive, "privateKeyFile": "ec.pem"},
+		},
+	} {
+		data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+		path := filepath.Join(dir, "bad.json")
+		os.WriteFile(path, data, 0600)
+		if err := utils.LoadKeyringFile(path); err == nil {
+			t.Errorf("keyring %s was accepted", data)
+		}
+	}
+}
+
+// ***********************************************
+func TestHandleWebSocket(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
 	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
 	defer server.Close()
 
@@ -478,10 +1708,7 @@ func TestHandleWebSocket(t *testing.T) {
 	defer ws.Close()
 
 	testUsername := "testuser"
-	token, err := utils.NewTokenString(testUsername)
-	if err != nil {
-		t.Fatalf("Could not generate test token: %v", err)
-	}
+	token, _ := newSessionToken(t, testUsername)
 
 	authMessage := struct {
 		Token string `json:"token"`
@@ -494,10 +1721,7 @@ func TestHandleWebSocket(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	clientsMu.RLock()
-	_, exists := clients[testUsername]
-	clientsMu.RUnlock()
-	if !exists {
+	if !clients.Connected(testUsername) {
 		t.Errorf("client connection was not stored for user: %s", testUsername)
 	}
 
@@ -515,10 +1739,1603 @@ func TestHandleWebSocket(t *testing.T) {
 	ws.Close()
 	time.Sleep(100 * time.Millisecond)
 
-	clientsMu.RLock()
-	_, stillExists := clients[testUsername]
-	clientsMu.RUnlock()
-	if stillExists {
+	if clients.Connected(testUsername) {
 		t.Errorf("client connection was not removed after websocket closed for user: %s", testUsername)
 	}
 }
+
+// ***********************************************
+func TestHandleGetUserConversation(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1", PublicKey: "publicKey1"},
+			"user2": {Username: "user2", PublicKey: "publicKey2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	// insert out of order to make sure history comes back sorted
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	for i := 2; i >= 0; i-- {
+		timestamp := base.Add(time.Duration(i) * time.Second)
+		message := Message{
+			ID:        fmt.Sprintf("msg%d", i),
+			ConvID:    conversation.ID,
+			To:        "user2",
+			From:      "user1",
+			Content:   "ciphertext",
+			Timestamp: &timestamp,
+		}
+		if err := testDB.AddMessageToConversation(message); err != nil {
+			t.Fatalf("Failed to add message: %v", err)
+		}
+	}
+
+	if err := testDB.AddMessageToConversation(Message{ID: "orphan", ConvID: "missing"}); err == nil {
+		t.Errorf("expected error adding message to a missing conversation")
+	}
+
+	request, _ := http.NewRequest("GET", "/api/conversation?id="+conversation.ID, nil)
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user1"))
+	responseRecorder := httptest.NewRecorder()
+
+	HandleGetUserConversation(responseRecorder, request)
+
+	result := responseRecorder.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v; got %v", http.StatusOK, result.StatusCode)
+	}
+
+	var conversationResponse Conversation
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&conversationResponse); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(conversationResponse.Messages) != 3 {
+		t.Fatalf("Incorrect number of messages: got %v want 3", len(conversationResponse.Messages))
+	}
+	for i, message := range conversationResponse.Messages {
+		if want := fmt.Sprintf("msg%d", i); message.ID != want {
+			t.Errorf("message %d out of order: got %v want %v", i, message.ID, want)
+		}
+	}
+}
+
+// ***********************************************
+func TestHandleGetUserConversationPagination(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	// msg1 and msg2 share a timestamp so the id has to break the tie
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	offsets := []int{0, 1, 1, 2, 3}
+	for i, offset := range offsets {
+		timestamp := base.Add(time.Duration(offset) * time.Second)
+		message := Message{ID: fmt.Sprintf("msg%d", i), ConvID: conversation.ID, From: "user1", Timestamp: &timestamp}
+		if err := testDB.AddMessageToConversation(message); err != nil {
+			t.Fatalf("Failed to add message: %v", err)
+		}
+	}
+
+	fetchPage := func(query string, wantStatus int) ConversationPage {
+		request, _ := http.NewRequest("GET", "/api/conversation?id="+conversation.ID+query, nil)
+		request = request.WithContext(context.WithValue(request.Context(), "username", "user1"))
+		responseRecorder := httptest.NewRecorder()
+
+		HandleGetUserConversation(responseRecorder, request)
+
+		if responseRecorder.Code != wantStatus {
+			t.Fatalf("%s: expected status %v; got %v", query, wantStatus, responseRecorder.Code)
+		}
+		var page ConversationPage
+		if wantStatus == http.StatusOK {
+			if err := json.NewDecoder(responseRecorder.Body).Decode(&page); err != nil {
+				t.Fatalf("Failed to decode response body: %v", err)
+			}
+		}
+		return page
+	}
+	ids := func(page ConversationPage) string {
+		var result []string
+		for _, message := range page.Messages {
+			result = append(result, message.ID)
+		}
+		return strings.Join(result, ",")
+	}
+
+	newest := fetchPage("&limit=2", http.StatusOK)
+	if got := ids(newest); got != "msg3,msg4" {
+		t.Errorf("newest page: got %v want msg3,msg4", got)
+	}
+	if newest.NextCursor == "" {
+		t.Fatalf("expected a cursor for older messages")
+	}
+
+	older := fetchPage("&limit=2&before="+newest.NextCursor, http.StatusOK)
+	if got := ids(older); got != "msg1,msg2" {
+		t.Errorf("older page: got %v want msg1,msg2", got)
+	}
+
+	oldest := fetchPage("&limit=2&before="+older.NextCursor, http.StatusOK)
+	if got := ids(oldest); got != "msg0" {
+		t.Errorf("oldest page: got %v want msg0", got)
+	}
+	if oldest.NextCursor != "" {
+		t.Errorf("expected no cursor after the oldest page; got %v", oldest.NextCursor)
+	}
+
+	after := fetchPage("&limit=2&after="+Cursor{Timestamp: base, ID: "msg0"}.Encode(), http.StatusOK)
+	if got := ids(after); got != "msg1,msg2" {
+		t.Errorf("after page: got %v want msg1,msg2", got)
+	}
+	rest := fetchPage("&limit=2&after="+after.NextCursor, http.StatusOK)
+	if got := ids(rest); got != "msg3,msg4" {
+		t.Errorf("after page: got %v want msg3,msg4", got)
+	}
+	if rest.NextCursor != "" {
+		t.Errorf("expected no cursor after the newest page; got %v", rest.NextCursor)
+	}
+
+	fetchPage("&limit=0", http.StatusBadRequest)
+	fetchPage("&before=not-a-cursor", http.StatusBadRequest)
+	fetchPage("&before="+newest.NextCursor+"&after="+newest.NextCursor, http.StatusBadRequest)
+}
+
+// ***********************************************
+func TestHandleGetUserConversationsSummary(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		created := base.Add(time.Duration(i) * time.Second)
+		conversation := Conversation{
+			ID: fmt.Sprintf("conv%d", i),
+			Participants: map[string]Participant{
+				"user1": {Username: "user1"},
+				"user2": {Username: "user2"},
+			},
+			LastActivity: &created,
+		}
+		if err := testDB.CreateConversation(conversation); err != nil {
+			t.Fatalf("Failed to insert conversation into database: %v", err)
+		}
+		ids = append(ids, conversation.ID)
+	}
+
+	// conv0 becomes the most recently active conversation
+	sent := base.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		timestamp := sent.Add(time.Duration(i) * time.Millisecond)
+		message := Message{ID: fmt.Sprintf("msg%d", i), ConvID: ids[0], From: "user2", Timestamp: &timestamp}
+		if err := testDB.AddMessageToConversation(message); err != nil {
+			t.Fatalf("Failed to add message: %v", err)
+		}
+	}
+
+	fetchSummaries := func(username, query string) ConversationSummaryPage {
+		request, _ := http.NewRequest("GET", "/api/conversations?view=summary"+query, nil)
+		request = request.WithContext(context.WithValue(request.Context(), "username", username))
+		responseRecorder := httptest.NewRecorder()
+
+		HandleGetUserConversations(responseRecorder, request)
+
+		if responseRecorder.Code != http.StatusOK {
+			t.Fatalf("expected status %v; got %v", http.StatusOK, responseRecorder.Code)
+		}
+		var page ConversationSummaryPage
+		if err := json.NewDecoder(responseRecorder.Body).Decode(&page); err != nil {
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
+		return page
+	}
+
+	first := fetchSummaries("user1", "&limit=2")
+	if len(first.Conversations) != 2 {
+		t.Fatalf("Incorrect number of summaries: got %v want 2", len(first.Conversations))
+	}
+	top := first.Conversations[0]
+	if top.ID != "conv0" || first.Conversations[1].ID != "conv2" {
+		t.Errorf("summaries out of order: got %v, %v", top.ID, first.Conversations[1].ID)
+	}
+	if top.LastMessage == nil || top.LastMessage.ID != "msg1" || top.LastMessage.From != "user2" {
+		t.Errorf("Incorrect last message: %+v", top.LastMessage)
+	}
+	if top.UnreadCount != 2 {
+		t.Errorf("Incorrect unread count: got %v want 2", top.UnreadCount)
+	}
+	if strings.Join(top.Participants, ",") != "user1,user2" {
+		t.Errorf("Incorrect participants: %v", top.Participants)
+	}
+	if first.NextCursor == "" {
+		t.Fatalf("expected a cursor for the next page")
+	}
+
+	second := fetchSummaries("user1", "&limit=2&before="+first.NextCursor)
+	if len(second.Conversations) != 1 || second.Conversations[0].ID != "conv1" {
+		t.Errorf("Incorrect second page: %+v", second.Conversations)
+	}
+	if second.NextCursor != "" {
+		t.Errorf("expected no cursor after the last page; got %v", second.NextCursor)
+	}
+
+	// the sender has nothing unread
+	if sender := fetchSummaries("user2", "&limit=1"); sender.Conversations[0].UnreadCount != 0 {
+		t.Errorf("sender unread count: got %v want 0", sender.Conversations[0].UnreadCount)
+	}
+
+	body, _ := json.Marshal(map[string]string{"conversationId": ids[0]})
+	request, _ := http.NewRequest("POST", "/api/mark-read", bytes.NewBuffer(body))
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user1"))
+	responseRecorder := httptest.NewRecorder()
+	HandleMarkConversationRead(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf("expected status %v; got %v", http.StatusOK, responseRecorder.Code)
+	}
+	if read := fetchSummaries("user1", "&limit=1"); read.Conversations[0].UnreadCount != 0 {
+		t.Errorf("unread count after mark-read: got %v want 0", read.Conversations[0].UnreadCount)
+	}
+}
+
+// ***********************************************
+// dialWebSocket connects to a test server running HandleWebSocket and
+// authenticates as username.
+func dialWebSocket(t *testing.T, serverURL, username string) *websocket.Conn {
+	t.Helper()
+	return dialDevice(t, serverURL, username, "")
+}
+
+// ***********************************************
+func dialDevice(t *testing.T, serverURL, username, deviceID string) *websocket.Conn {
+	t.Helper()
+	return dialProtocol(t, serverURL, username, deviceID, 0)
+}
+func dialProtocol(t *testing.T, serverURL, username, deviceID string, version int) *websocket.Conn {
+	t.Helper()
+	token, _ := newSessionToken(t, username)
+	return dialToken(t, serverURL, token, deviceID, version)
+}
+
+// ***********************************************
+func dialToken(t *testing.T, serverURL, token, deviceID string, version int) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(serverURL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Could not open a websocket connection on %s %v", url, err)
+	}
+
+	if err := ws.WriteJSON(struct {
+		Token    string `json:"token"`
+		DeviceID string `json:"deviceId,omitempty"`
+		V        int    `json:"v,omitempty"`
+	}{Token: token, DeviceID: deviceID, V: version}); err != nil {
+		t.Fatalf("Could not send auth message: %v", err)
+	}
+	return ws
+}
+
+// ***********************************************
+// newSessionToken starts a session for username and returns an access
+// token for it along with the session id.
+func newSessionToken(t *testing.T, username string) (string, string) {
+	t.Helper()
+	session, err := startSession(username, httptest.NewRequest("POST", "/api/login", nil))
+	if err != nil {
+		t.Fatalf("Could not start session: %v", err)
+	}
+	token, err := utils.NewTokenString(username, session.ID)
+	if err != nil {
+		t.Fatalf("Could not generate test token: %v", err)
+	}
+	return token, session.ID
+}
+
+// ***********************************************
+func TestConversationMembership(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	private := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	own := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user3": {Username: "user3"},
+			"user1": {Username: "user1"},
+		},
+	}
+	for _, conversation := range []Conversation{private, own} {
+		if err := testDB.CreateConversation(conversation); err != nil {
+			t.Fatalf("Failed to insert conversation into database: %v", err)
+		}
+	}
+
+	asUser := func(request *http.Request, username string) *http.Request {
+		return request.WithContext(context.WithValue(request.Context(), "username", username))
+	}
+
+	/////////////////////////////////////////////////
+	// non-members cannot read
+	/////////////////////////////////////////////////
+	request, _ := http.NewRequest("GET", "/api/conversation?id="+private.ID, nil)
+	responseRecorder := httptest.NewRecorder()
+	HandleGetUserConversation(responseRecorder, asUser(request, "user3"))
+	if responseRecorder.Code != http.StatusNotFound {
+		t.Errorf("read: expected status %v; got %v", http.StatusNotFound, responseRecorder.Code)
+	}
+
+	request, _ = http.NewRequest("GET", "/api/conversation?id="+private.ID, nil)
+	responseRecorder = httptest.NewRecorder()
+	HandleGetUserConversation(responseRecorder, asUser(request, "user2"))
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf("member read: expected status %v; got %v", http.StatusOK, responseRecorder.Code)
+	}
+
+	/////////////////////////////////////////////////
+	// non-members cannot write keys or read markers
+	/////////////////////////////////////////////////
+	body, _ := json.Marshal(map[string]interface{}{
+		"ConversationId": private.ID,
+		"EncryptedKeys":  map[string]string{"user1": "forged"},
+	})
+	request, _ = http.NewRequest("POST", "/api/symmetric-key", bytes.NewBuffer(body))
+	responseRecorder = httptest.NewRecorder()
+	HandleSymmetricKey(responseRecorder, asUser(request, "user3"))
+	if responseRecorder.Code != http.StatusNotFound {
+		t.Errorf("symmetric key: expected status %v; got %v", http.StatusNotFound, responseRecorder.Code)
+	}
+	stored, err := testDB.GetUserConversation("user1", private.ID)
+	if err != nil {
+		t.Fatalf("Failed to load conversation: %v", err)
+	}
+	if stored.Participants["user1"].EncryptedSymmetricKey == "forged" {
+		t.Errorf("non-member overwrote a symmetric key")
+	}
+
+	/////////////////////////////////////////////////
+	// members cannot store keys that are not wrapped keys
+	/////////////////////////////////////////////////
+	for name, key := range map[string]string{
+		"not base64": "not base64!",
+		"too short":  base64.StdEncoding.EncodeToString([]byte("short")),
+	} {
+		body, _ = json.Marshal(map[string]interface{}{
+			"ConversationId": private.ID,
+			"EncryptedKeys":  map[string]string{"user2": key},
+		})
+		request, _ = http.NewRequest("POST", "/api/symmetric-key", bytes.NewBuffer(body))
+		responseRecorder = httptest.NewRecorder()
+		HandleSymmetricKey(responseRecorder, asUser(request, "user1"))
+		if responseRecorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %v; got %v", name, http.StatusBadRequest, responseRecorder.Code)
+		}
+		if !strings.Contains(responseRecorder.Body.String(), `"EncryptedKeys.user2"`) {
+			t.Errorf("%s: field not reported: %s", name, responseRecorder.Body.String())
+		}
+	}
+	unchanged, err := testDB.GetUserConversation("user1", private.ID)
+	if err != nil {
+		t.Fatalf("Failed to load conversation: %v", err)
+	}
+	if unchanged.Participants["user2"].EncryptedSymmetricKey != stored.Participants["user2"].EncryptedSymmetricKey {
+		t.Errorf("malformed symmetric key was stored")
+	}
+
+	body, _ = json.Marshal(map[string]string{"conversationId": private.ID})
+	request, _ = http.NewRequest("POST", "/api/mark-read", bytes.NewBuffer(body))
+	responseRecorder = httptest.NewRecorder()
+	HandleMarkConversationRead(responseRecorder, asUser(request, "user3"))
+	if responseRecorder.Code != http.StatusNotFound {
+		t.Errorf("mark-read: expected status %v; got %v", http.StatusNotFound, responseRecorder.Code)
+	}
+
+	/////////////////////////////////////////////////
+	// non-members cannot post over the websocket
+	/////////////////////////////////////////////////
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	ws := dialWebSocket(t, server.URL, "user3")
+	defer ws.Close()
+
+	if err := ws.WriteJSON(Message{ConvID: private.ID, To: "user1", From: "user3", Content: "intrusion"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var rejection ErrorFrame
+	if err := ws.ReadJSON(&rejection); err != nil {
+		t.Fatalf("Could not read error frame: %v", err)
+	}
+	if rejection.Type != "error" || rejection.Code != "not_found" {
+		t.Errorf("unexpected error frame: %+v", rejection)
+	}
+
+	if err := ws.WriteJSON(Message{ConvID: own.ID, To: "user1", From: "user3", Content: "hello"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	var echo Message
+	if err := ws.ReadJSON(&echo); err != nil {
+		t.Fatalf("Could not read echo: %v", err)
+	}
+	if echo.ConvID != own.ID {
+		t.Errorf("echo for wrong conversation: got %v want %v", echo.ConvID, own.ID)
+	}
+
+	messages, err := testDB.GetConversationMessages(private.ID)
+	if err != nil {
+		t.Fatalf("Failed to load messages: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("non-member message was stored: %+v", messages)
+	}
+}
+
+// ***********************************************
+func TestWebSocketSenderIdentity(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	ws := dialWebSocket(t, server.URL, "user1")
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	/////////////////////////////////////////////////
+	// recipients outside the conversation are rejected
+	/////////////////////////////////////////////////
+	if err := ws.WriteJSON(Message{ID: "client-1", ConvID: conversation.ID, To: "user3", Content: "hi"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	var rejection ErrorFrame
+	if err := ws.ReadJSON(&rejection); err != nil {
+		t.Fatalf("Could not read error frame: %v", err)
+	}
+	if rejection.Type != "error" || rejection.Code != "invalid_recipient" || rejection.ID != "client-1" {
+		t.Errorf("unexpected error frame: %+v", rejection)
+	}
+
+	/////////////////////////////////////////////////
+	// a forged sender is replaced by the authenticated user
+	/////////////////////////////////////////////////
+	if err := ws.WriteJSON(Message{ConvID: conversation.ID, To: "user2", From: "user2", Content: "forged"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	var echo Message
+	if err := ws.ReadJSON(&echo); err != nil {
+		t.Fatalf("Could not read echo: %v", err)
+	}
+	if echo.From != "user1" {
+		t.Errorf("sender was not taken from the connection: got %v want user1", echo.From)
+	}
+}
+
+// ***********************************************
+func TestWebSocketGroupFanOut(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	members := []string{"user1", "user2", "user3"}
+	conversation := Conversation{
+		ID:           uuid.NewString(),
+		Participants: map[string]Participant{},
+	}
+	for _, member := range members {
+		conversation.Participants[member] = Participant{Username: member}
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	sockets := make(map[string]*websocket.Conn)
+	for _, member := range members {
+		ws := dialWebSocket(t, server.URL, member)
+		defer ws.Close()
+		sockets[member] = ws
+	}
+	waitForClients(t, members...)
+
+	// no To: the message is for the whole conversation
+	if err := sockets["user1"].WriteJSON(Message{ConvID: conversation.ID, Content: "ciphertext"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+
+	for _, member := range members {
+		ws := sockets[member]
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var received Message
+		if err := ws.ReadJSON(&received); err != nil {
+			t.Fatalf("%s did not receive the message: %v", member, err)
+		}
+		if received.Content != "ciphertext" || received.From != "user1" {
+			t.Errorf("%s received the wrong message: %+v", member, received)
+		}
+	}
+}
+
+// ***********************************************
+// waitForClients blocks until every user has a registered connection.
+func waitForClients(t *testing.T, usernames ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		registered := 0
+		for _, username := range usernames {
+			if clients.Connected(username) {
+				registered++
+			}
+		}
+		if registered == len(usernames) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("clients %v never registered", usernames)
+}
+
+// ***********************************************
+// waitForDevices blocks until username has exactly n registered devices.
+func waitForDevices(t *testing.T, username string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(clients.Devices(username)) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s has %d devices; want %d", username, len(clients.Devices(username)), n)
+}
+
+// ***********************************************
+func TestWebSocketMultipleDevices(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	laptop := dialDevice(t, server.URL, "user1", "laptop")
+	defer laptop.Close()
+	phone := dialDevice(t, server.URL, "user1", "phone")
+	defer phone.Close()
+	other := dialWebSocket(t, server.URL, "user2")
+	defer other.Close()
+	waitForDevices(t, "user1", 2)
+	waitForDevices(t, "user2", 1)
+
+	/////////////////////////////////////////////////
+	// every device of every participant receives the message
+	/////////////////////////////////////////////////
+	if err := laptop.WriteJSON(Message{ConvID: conversation.ID, Content: "from the laptop"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	for name, ws := range map[string]*websocket.Conn{"laptop": laptop, "phone": phone, "user2": other} {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var received Message
+		if err := ws.ReadJSON(&received); err != nil {
+			t.Fatalf("%s did not receive the message: %v", name, err)
+		}
+		if received.Content != "from the laptop" {
+			t.Errorf("%s received the wrong message: %+v", name, received)
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// devices disconnect independently
+	/////////////////////////////////////////////////
+	phone.Close()
+	waitForDevices(t, "user1", 1)
+	if _, ok := clients.Devices("user1")["laptop"]; !ok {
+		t.Errorf("laptop was unregistered when the phone disconnected")
+	}
+
+	/////////////////////////////////////////////////
+	// reconnecting the same device replaces its old connection
+	/////////////////////////////////////////////////
+	replacement := dialDevice(t, server.URL, "user1", "laptop")
+	defer replacement.Close()
+	laptop.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := laptop.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("old laptop connection was not closed: %v", err)
+	}
+	waitForDevices(t, "user1", 1)
+}
+
+// ***********************************************
+func writeFrame(t *testing.T, ws *websocket.Conn, typ, id string, payload interface{}) {
+	t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Could not marshal payload: %v", err)
+	}
+	if err := ws.WriteJSON(Envelope{V: protocolVersion, Type: typ, ID: id, Payload: raw}); err != nil {
+		t.Fatalf("Could not send %s frame: %v", typ, err)
+	}
+}
+
+// ***********************************************
+// readFrame returns the next envelope on ws other than presence updates,
+// which depend on who happens to be connected, unless those are wanted.
+// The payload is decoded into v when v is not nil.
+func readFrame(t *testing.T, ws *websocket.Conn, typ string, v interface{}) Envelope {
+	t.Helper()
+	for {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var env Envelope
+		if err := ws.ReadJSON(&env); err != nil {
+			t.Fatalf("did not receive a %s frame: %v", typ, err)
+		}
+		if env.Type == FramePresence && typ != FramePresence {
+			continue
+		}
+		if env.Type != typ {
+			t.Fatalf("expected a %s frame, got %s %s", typ, env.Type, env.Payload)
+		}
+		if v != nil {
+			if err := json.Unmarshal(env.Payload, v); err != nil {
+				t.Fatalf("Could not decode %s payload: %v", typ, err)
+			}
+		}
+		return env
+	}
+}
+
+// ***********************************************
+// expectNoFrame fails if anything but a presence update arrives soon. A
+// timed out read leaves the connection unusable, so this is only ever
+// the last read on ws.
+func expectNoFrame(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+	for {
+		ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		var env Envelope
+		if err := ws.ReadJSON(&env); err != nil {
+			return
+		}
+		if env.Type != FramePresence {
+			t.Errorf("received an unexpected frame: %s %s", env.Type, env.Payload)
+			return
+		}
+	}
+}
+
+// ***********************************************
+func TestWebSocketOfflineCatchUp(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	// the first connection starts user2's delivery cursor
+	offline := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	waitForDevices(t, "user2", 1)
+	offline.Close()
+	waitForDevices(t, "user2", 0)
+
+	sender := dialWebSocket(t, server.URL, "user1")
+	defer sender.Close()
+	waitForDevices(t, "user1", 1)
+	send := func(content string) {
+		t.Helper()
+		if err := sender.WriteJSON(Message{ConvID: conversation.ID, Content: content}); err != nil {
+			t.Fatalf("Could not send message: %v", err)
+		}
+		sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var echo Message
+		if err := sender.ReadJSON(&echo); err != nil {
+			t.Fatalf("sender did not receive its echo: %v", err)
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// messages sent while user2 is away are stored
+	/////////////////////////////////////////////////
+	missed := []string{"first", "second", "third"}
+	for _, content := range missed {
+		send(content)
+	}
+
+	/////////////////////////////////////////////////
+	// reconnecting replays them in order, ahead of live traffic
+	/////////////////////////////////////////////////
+	receiver := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	waitForDevices(t, "user2", 1)
+	send("live")
+
+	var last Message
+	for _, want := range append(missed, "live") {
+		readFrame(t, receiver, FrameMessage, &last)
+		if last.Content != want {
+			t.Fatalf("expected %q, got %+v", want, last)
+		}
+	}
+	expectNoFrame(t, receiver)
+
+	/////////////////////////////////////////////////
+	// after an ack nothing is replayed again
+	/////////////////////////////////////////////////
+	waitForCursor := func(device, messageID string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			cursor, err := testDB.GetDeliveryCursor("user2", device)
+			if err == nil && cursor.ID == messageID {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("delivery cursor of %s did not advance: %+v %v", device, cursor, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	writeFrame(t, receiver, FrameAck, "ack1", AckPayload{MessageID: last.ID})
+	waitForCursor("phone", last.ID)
+	receiver.Close()
+	waitForDevices(t, "user2", 0)
+
+	receiver = dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	defer receiver.Close()
+	waitForDevices(t, "user2", 1)
+
+	/////////////////////////////////////////////////
+	// acks for messages the user cannot see are rejected, and since
+	// nothing was replayed the error is the first frame to arrive
+	/////////////////////////////////////////////////
+	writeFrame(t, receiver, FrameAck, "ack2", AckPayload{MessageID: uuid.NewString()})
+	var rejection ErrorPayload
+	env := readFrame(t, receiver, FrameError, &rejection)
+	if env.ID != "ack2" || rejection.Code != "not_found" {
+		t.Errorf("expected a not_found error for ack2, got %s %+v", env.ID, rejection)
+	}
+
+	/////////////////////////////////////////////////
+	// each device has its own cursor, so what the phone acks is still
+	// replayed to the tablet
+	/////////////////////////////////////////////////
+	tablet := dialProtocol(t, server.URL, "user2", "tablet", protocolVersion)
+	waitForDevices(t, "user2", 2)
+	tablet.Close()
+	waitForDevices(t, "user2", 1)
+
+	send("while the tablet was away")
+	var delivered Message
+	readFrame(t, receiver, FrameMessage, &delivered)
+	writeFrame(t, receiver, FrameAck, "ack3", AckPayload{MessageID: delivered.ID})
+	waitForCursor("phone", delivered.ID)
+
+	tablet = dialProtocol(t, server.URL, "user2", "tablet", protocolVersion)
+	defer tablet.Close()
+	var replayed Message
+	readFrame(t, tablet, FrameMessage, &replayed)
+	if replayed.ID != delivered.ID {
+		t.Errorf("expected the tablet to get %s, got %+v", delivered.ID, replayed)
+	}
+}
+
+// ***********************************************
+func TestWebSocketReceipts(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	sender := dialProtocol(t, server.URL, "user1", "laptop", protocolVersion)
+	defer sender.Close()
+	receiver := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	defer receiver.Close()
+	waitForClients(t, "user1", "user2")
+
+	writeFrame(t, sender, FrameSend, "m1", Message{ConvID: conversation.ID, Content: "hello"})
+	var echo, received Message
+	readFrame(t, sender, FrameMessage, &echo)
+	readFrame(t, receiver, FrameMessage, &received)
+
+	/////////////////////////////////////////////////
+	// each new receipt is pushed to the author, and reading clears
+	// the reader's unread count
+	/////////////////////////////////////////////////
+	for _, status := range []string{ReceiptDelivered, ReceiptRead} {
+		writeFrame(t, receiver, FrameAck, "", AckPayload{MessageID: received.ID, Status: status})
+		var receipt ReceiptPayload
+		readFrame(t, sender, FrameReceipt, &receipt)
+		if receipt.MessageID != received.ID || receipt.Username != "user2" || receipt.Status != status {
+			t.Errorf("unexpected receipt: %+v", receipt)
+		}
+		stored, err := testDB.GetUserConversation("user2", conversation.ID)
+		if err != nil {
+			t.Fatalf("Failed to load conversation: %v", err)
+		}
+		want := 1
+		if status == ReceiptRead {
+			want = 0
+		}
+		if unread := stored.Participants["user2"].UnreadCount; unread != want {
+			t.Errorf("after a %s receipt: unread count %d; want %d", status, unread, want)
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// repeated acks and the author's own ack push nothing, so the
+	// next frame the author sees is the echo of its next message
+	/////////////////////////////////////////////////
+	writeFrame(t, receiver, FrameAck, "", AckPayload{MessageID: received.ID, Status: ReceiptRead})
+	writeFrame(t, sender, FrameAck, "", AckPayload{MessageID: echo.ID})
+	time.Sleep(100 * time.Millisecond)
+	writeFrame(t, sender, FrameSend, "m2", Message{ConvID: conversation.ID, Content: "again"})
+	var next Message
+	readFrame(t, sender, FrameMessage, &next)
+	if next.Content != "again" {
+		t.Errorf("expected the echo, got %+v", next)
+	}
+	readFrame(t, receiver, FrameMessage, nil)
+
+	/////////////////////////////////////////////////
+	// unknown statuses are rejected
+	/////////////////////////////////////////////////
+	writeFrame(t, receiver, FrameAck, "bad", AckPayload{MessageID: received.ID, Status: "seen"})
+	var rejection ErrorPayload
+	env := readFrame(t, receiver, FrameError, &rejection)
+	if env.ID != "bad" || rejection.Code != "bad_request" {
+		t.Errorf("unexpected error frame: %s %+v", env.ID, rejection)
+	}
+
+	/////////////////////////////////////////////////
+	// the REST endpoint reports the stored state
+	/////////////////////////////////////////////////
+	request, _ := http.NewRequest("GET", "/api/receipts?id="+conversation.ID, nil)
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user1"))
+	responseRecorder := httptest.NewRecorder()
+	HandleGetReceipts(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf("expected status %v; got %v", http.StatusOK, responseRecorder.Code)
+	}
+	var page ReceiptPage
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(page.Receipts) != 2 {
+		t.Fatalf("expected receipts for 2 messages, got %+v", page.Receipts)
+	}
+	first := page.Receipts[0]
+	if first.MessageID != received.ID || first.Receipts["user2"].Delivered == nil || first.Receipts["user2"].Read == nil {
+		t.Errorf("unexpected receipts for the first message: %+v", first)
+	}
+	if _, ok := first.Receipts["user1"]; ok {
+		t.Errorf("the author has a receipt for its own message: %+v", first)
+	}
+	if len(page.Receipts[1].Receipts) != 0 {
+		t.Errorf("unacknowledged message has receipts: %+v", page.Receipts[1])
+	}
+
+	request, _ = http.NewRequest("GET", "/api/receipts?id="+conversation.ID, nil)
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user3"))
+	responseRecorder = httptest.NewRecorder()
+	HandleGetReceipts(responseRecorder, request)
+	if responseRecorder.Code != http.StatusNotFound {
+		t.Errorf("non-member got status %v; want %v", responseRecorder.Code, http.StatusNotFound)
+	}
+}
+
+// ***********************************************
+func TestWebSocketEnvelope(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	ws := dialProtocol(t, server.URL, "user1", "laptop", protocolVersion)
+	defer ws.Close()
+	legacy := dialWebSocket(t, server.URL, "user2")
+	defer legacy.Close()
+	waitForClients(t, "user1", "user2")
+
+	expectError := func(id, code string) {
+		t.Helper()
+		var rejection ErrorPayload
+		env := readFrame(t, ws, FrameError, &rejection)
+		if env.ID != id || rejection.Code != code {
+			t.Errorf("expected %s error for %q, got %q %+v", code, id, env.ID, rejection)
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// rejected frames get a structured error carrying their id
+	/////////////////////////////////////////////////
+	writeFrame(t, ws, "shout", "c1", struct{}{})
+	expectError("c1", "unknown_type")
+
+	if err := ws.WriteJSON(Envelope{V: protocolVersion + 1, Type: FrameSend, ID: "c2"}); err != nil {
+		t.Fatalf("Could not send frame: %v", err)
+	}
+	expectError("c2", "unsupported_version")
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatalf("Could not send frame: %v", err)
+	}
+	expectError("", "bad_request")
+
+	writeFrame(t, ws, FrameSend, "c3", Message{ConvID: "missing"})
+	expectError("c3", "not_found")
+
+	writeFrame(t, ws, FrameTyping, "c4", "not an object")
+	expectError("c4", "bad_request")
+
+	/////////////////////////////////////////////////
+	// a send without a message id uses the frame's id, and clients
+	// of either version get the message in their own encoding
+	/////////////////////////////////////////////////
+	writeFrame(t, ws, FrameSend, "c5", Message{ConvID: conversation.ID, Content: "hello"})
+	var echo Message
+	env := readFrame(t, ws, FrameMessage, &echo)
+	if env.ID != "c5" || echo.ID != "c5" || echo.From != "user1" || echo.Content != "hello" {
+		t.Errorf("unexpected echo: %s %+v", env.ID, echo)
+	}
+	legacy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var bare Message
+	if err := legacy.ReadJSON(&bare); err != nil || bare.ID != "c5" {
+		t.Errorf("version 0 client did not get the bare message: %+v %v", bare, err)
+	}
+
+	/////////////////////////////////////////////////
+	// version 0 clients only hear about messages, so the next thing
+	// the legacy client sees is the echo of its own message, not the
+	// typing indicator sent before it
+	/////////////////////////////////////////////////
+	writeFrame(t, ws, FrameTyping, "", TypingPayload{ConvID: conversation.ID, Typing: true})
+	if err := legacy.WriteJSON(Message{ConvID: conversation.ID, Content: "reply"}); err != nil {
+		t.Fatalf("Could not send message: %v", err)
+	}
+	legacy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := legacy.ReadJSON(&bare); err != nil || bare.Content != "reply" {
+		t.Errorf("expected the echo, got %+v %v", bare, err)
+	}
+	readFrame(t, ws, FrameMessage, nil)
+}
+
+// ***********************************************
+func TestWebSocketTypingAndPresence(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	readPresence := func(ws *websocket.Conn) PresencePayload {
+		t.Helper()
+		var presence PresencePayload
+		readFrame(t, ws, FramePresence, &presence)
+		return presence
+	}
+
+	first := dialProtocol(t, server.URL, "user1", "laptop", protocolVersion)
+	defer first.Close()
+	waitForDevices(t, "user1", 1)
+
+	/////////////////////////////////////////////////
+	// connecting announces the user and tells it who is already online
+	/////////////////////////////////////////////////
+	second := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	defer second.Close()
+	if p := readPresence(first); p.Username != "user2" || p.Status != PresenceOnline {
+		t.Errorf("unexpected presence: %+v", p)
+	}
+	if p := readPresence(second); p.Username != "user1" || p.Status != PresenceOnline {
+		t.Errorf("unexpected presence snapshot: %+v", p)
+	}
+
+	/////////////////////////////////////////////////
+	// typing indicators reach the other participants
+	/////////////////////////////////////////////////
+	writeFrame(t, first, FrameTyping, "", TypingPayload{ConvID: conversation.ID, Typing: true})
+	var typing TypingPayload
+	readFrame(t, second, FrameTyping, &typing)
+	if typing.ConvID != conversation.ID || typing.Username != "user1" || !typing.Typing {
+		t.Errorf("unexpected typing indicator: %+v", typing)
+	}
+
+	/////////////////////////////////////////////////
+	// clients may set themselves away, but not offline
+	/////////////////////////////////////////////////
+	writeFrame(t, first, FramePresence, "p1", PresencePayload{Status: PresenceOffline})
+	var rejection ErrorPayload
+	if env := readFrame(t, first, FrameError, &rejection); env.ID != "p1" || rejection.Code != "bad_request" {
+		t.Errorf("unexpected error frame: %s %+v", env.ID, rejection)
+	}
+	writeFrame(t, first, FramePresence, "", PresencePayload{Status: PresenceAway})
+	if p := readPresence(second); p.Username != "user1" || p.Status != PresenceAway {
+		t.Errorf("unexpected presence: %+v", p)
+	}
+
+	/////////////////////////////////////////////////
+	// the last device disconnecting takes the user offline
+	/////////////////////////////////////////////////
+	second.Close()
+	if p := readPresence(first); p.Username != "user2" || p.Status != PresenceOffline {
+		t.Errorf("unexpected presence: %+v", p)
+	}
+}
+
+// ***********************************************
+func TestDeleteAccount(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer func() { accountDeletionPolicy = AccountDeletionTombstone }()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.MinCost)
+	for _, username := range []string{"alice", "bob", "dave"} {
+		if err := testDB.CreateUser(User{Username: username, Password: string(hashedPassword)}); err != nil {
+			t.Fatalf("Failed to insert test user: %v", err)
+		}
+	}
+	conversation := func(participants ...string) string {
+		t.Helper()
+		c := Conversation{ID: uuid.NewString(), Participants: map[string]Participant{}}
+		for _, username := range participants {
+			c.Participants[username] = Participant{Username: username, EncryptedSymmetricKey: "key-" + username}
+		}
+		if err := testDB.CreateConversation(c); err != nil {
+			t.Fatalf("Failed to insert conversation into database: %v", err)
+		}
+		return c.ID
+	}
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	addMessage := func(id, convID, from string) {
+		t.Helper()
+		timestamp := base.Add(time.Duration(len(id)) * time.Millisecond)
+		message := Message{ID: id, ConvID: convID, From: from, Content: "ciphertext", Timestamp: &timestamp}
+		if err := testDB.AddMessageToConversation(message); err != nil {
+			t.Fatalf("Failed to add message: %v", err)
+		}
+	}
+	deleteAccountRequest := func(token, password string) int {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"password": password})
+		request, _ := http.NewRequest("DELETE", "/api/account", bytes.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		protectedEndpoint(HandleDeleteAccount)(responseRecorder, request)
+		return responseRecorder.Code
+	}
+
+	shared := conversation("alice", "bob")
+	alone := conversation("alice")
+	addMessage("a1", shared, "alice")
+	addMessage("b11", shared, "bob")
+	if _, err := testDB.RecordReceipt("b11", "alice", ReceiptRead, base); err != nil {
+		t.Fatalf("Failed to record receipt: %v", err)
+	}
+	if err := testDB.HideMessage("b11", "alice"); err != nil {
+		t.Fatalf("Failed to hide message: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	token, _ := newSessionToken(t, "alice")
+	aliceWS := dialToken(t, server.URL, token, "laptop", protocolVersion)
+	defer aliceWS.Close()
+	bobWS := dialProtocol(t, server.URL, "bob", "phone", protocolVersion)
+	defer bobWS.Close()
+	legacy := dialDevice(t, server.URL, "bob", "laptop")
+	defer legacy.Close()
+	waitForDevices(t, "alice", 1)
+	waitForDevices(t, "bob", 2)
+
+	/////////////////////////////////////////////////
+	// deleting takes the password again
+	/////////////////////////////////////////////////
+	if code := deleteAccountRequest(token, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: got status %v; want %v", code, http.StatusUnauthorized)
+	}
+	if code := deleteAccountRequest(token, "testpassword"); code != http.StatusOK {
+		t.Fatalf("delete account: got status %v", code)
+	}
+
+	/////////////////////////////////////////////////
+	// the user and their sessions are gone
+	/////////////////////////////////////////////////
+	if _, err := testDB.FindUserByUsername("alice"); err != ErrNotFound {
+		t.Errorf("user still exists: %v", err)
+	}
+	if _, err := utils.ValidateTokenFromString(token); err == nil {
+		t.Errorf("access token survived the account")
+	}
+	waitForDevices(t, "alice", 0)
+
+	/////////////////////////////////////////////////
+	// the others in the conversation hear about it
+	/////////////////////////////////////////////////
+	var leave LeavePayload
+	readFrame(t, bobWS, FrameLeave, &leave)
+	if leave.ConvID != shared || leave.Username != "alice" || leave.Messages != AccountDeletionTombstone {
+		t.Errorf("unexpected leave payload: %+v", leave)
+	}
+	legacy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var update DeleteMessageResponse
+	if err := legacy.ReadJSON(&update); err != nil || update.Type != "conversationUpdate" {
+		t.Fatalf("version 0 client did not get a conversationUpdate: %+v %v", update, err)
+	}
+	if _, ok := update.Conversation.Participants["alice"]; ok || len(update.Conversation.Participants) != 1 {
+		t.Errorf("update still lists alice: %+v", update.Conversation.Participants)
+	}
+
+	/////////////////////////////////////////////////
+	// the user leaves every conversation, and their messages are
+	// tombstoned by default
+	/////////////////////////////////////////////////
+	remaining, err := testDB.GetUserConversation("bob", shared)
+	if err != nil {
+		t.Fatalf("Failed to read conversation: %v", err)
+	}
+	if _, ok := remaining.Participants["alice"]; ok {
+		t.Errorf("alice is still a participant")
+	}
+	if remaining.Participants["bob"].EncryptedSymmetricKey != "key-bob" {
+		t.Errorf("bob lost his key: %+v", remaining.Participants["bob"])
+	}
+	all, _ := testDB.GetAllConversations()
+	for _, c := range all {
+		if c.ID == alone {
+			t.Errorf("conversation with nobody left in it was kept")
+		}
+	}
+	messages, _, _ := testDB.GetMessagePage(shared, MessagePage{Limit: 10, Viewer: "bob"})
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].ID != "a1" || !messages[0].Deleted || messages[0].Content != "" {
+		t.Errorf("alice's message was not tombstoned: %+v", messages[0])
+	}
+	if _, ok := messages[1].Receipts["alice"]; ok || len(messages[1].HiddenFor) != 0 {
+		t.Errorf("alice's receipts were kept: %+v", messages[1])
+	}
+
+	/////////////////////////////////////////////////
+	// or anonymized, if that is the server's policy
+	/////////////////////////////////////////////////
+	accountDeletionPolicy = AccountDeletionAnonymize
+	other := conversation("dave", "bob")
+	addMessage("d1", other, "dave")
+	daveToken, _ := newSessionToken(t, "dave")
+	if code := deleteAccountRequest(daveToken, "testpassword"); code != http.StatusOK {
+		t.Fatalf("delete account: got status %v", code)
+	}
+	readFrame(t, bobWS, FrameLeave, &leave)
+	if leave.ConvID != other || leave.Messages != AccountDeletionAnonymize {
+		t.Errorf("unexpected leave payload: %+v", leave)
+	}
+	messages, _, _ = testDB.GetMessagePage(other, MessagePage{Limit: 10, Viewer: "bob"})
+	if len(messages) != 1 || messages[0].From != DeletedUsername || messages[0].Content != "ciphertext" || messages[0].Deleted {
+		t.Errorf("dave's message was not anonymized: %+v", messages)
+	}
+	remaining, _ = testDB.GetUserConversation("bob", other)
+	if remaining.LastMessage == nil || remaining.LastMessage.From != DeletedUsername {
+		t.Errorf("last message still names dave: %+v", remaining.LastMessage)
+	}
+}
+
+// ***********************************************
+func TestDeleteMessage(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	for i, from := range []string{"user1", "user2"} {
+		timestamp := base.Add(time.Duration(i) * time.Second)
+		message := Message{
+			ID:        fmt.Sprintf("msg%d", i),
+			ConvID:    conversation.ID,
+			From:      from,
+			Content:   "ciphertext",
+			Timestamp: &timestamp,
+		}
+		if err := testDB.AddMessageToConversation(message); err != nil {
+			t.Fatalf("Failed to add message: %v", err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	author := dialProtocol(t, server.URL, "user1", "laptop", protocolVersion)
+	defer author.Close()
+	phone := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	defer phone.Close()
+	legacy := dialDevice(t, server.URL, "user2", "laptop")
+	defer legacy.Close()
+	waitForDevices(t, "user1", 1)
+	waitForDevices(t, "user2", 2)
+
+	deleteOverREST := func(username, messageID, scope string) int {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{
+			"currentConversationID": conversation.ID,
+			"messageID":             messageID,
+			"scope":                 scope,
+		})
+		request, _ := http.NewRequest("DELETE", "/api/delete-message", bytes.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), "username", username))
+		responseRecorder := httptest.NewRecorder()
+		HandleDeleteMessage(responseRecorder, request)
+		return responseRecorder.Code
+	}
+	history := func(username string) []Message {
+		t.Helper()
+		messages, _, err := testDB.GetMessagePage(conversation.ID, MessagePage{Limit: 10, Viewer: username})
+		if err != nil {
+			t.Fatalf("Failed to read history: %v", err)
+		}
+		return messages
+	}
+	readUpdate := func() Conversation {
+		t.Helper()
+		legacy.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var update DeleteMessageResponse
+		if err := legacy.ReadJSON(&update); err != nil || update.Type != "conversationUpdate" {
+			t.Fatalf("version 0 client did not get a conversationUpdate: %+v %v", update, err)
+		}
+		return update.Conversation
+	}
+
+	/////////////////////////////////////////////////
+	// deleting for yourself, the default, hides the message from you
+	// alone and only your own devices hear about it
+	/////////////////////////////////////////////////
+	if code := deleteOverREST("user2", "msg0", ""); code != http.StatusOK {
+		t.Fatalf("delete for me: got status %v", code)
+	}
+	var deletion DeletePayload
+	readFrame(t, phone, FrameDelete, &deletion)
+	if deletion.MessageID != "msg0" || deletion.Scope != DeleteForMe {
+		t.Errorf("unexpected delete event: %+v", deletion)
+	}
+	if update := readUpdate(); len(update.Messages) != 1 || update.Messages[0].ID != "msg1" {
+		t.Errorf("conversationUpdate still shows the hidden message: %+v", update.Messages)
+	}
+	if messages := history("user2"); len(messages) != 1 || messages[0].ID != "msg1" {
+		t.Errorf("user2 still sees the hidden message: %+v", messages)
+	}
+	if messages := history("user1"); len(messages) != 2 {
+		t.Errorf("user1 lost a message user2 deleted for themselves: %+v", messages)
+	}
+
+	/////////////////////////////////////////////////
+	// only the author may delete for everyone
+	/////////////////////////////////////////////////
+	if code := deleteOverREST("user2", "msg0", DeleteForEveryone); code != http.StatusForbidden {
+		t.Errorf("non-author delete for everyone: got status %v; want %v", code, http.StatusForbidden)
+	}
+	writeFrame(t, author, FrameDelete, "d1", DeletePayload{MessageID: "msg1", Scope: DeleteForEveryone})
+	var rejection ErrorPayload
+	if env := readFrame(t, author, FrameError, &rejection); env.ID != "d1" || rejection.Code != "forbidden" {
+		t.Errorf("unexpected error frame: %s %+v", env.ID, rejection)
+	}
+	if code := deleteOverREST("user1", "missing", DeleteForEveryone); code != http.StatusNotFound {
+		t.Errorf("missing message: got status %v; want %v", code, http.StatusNotFound)
+	}
+	if code := deleteOverREST("user1", "msg0", "nobody"); code != http.StatusBadRequest {
+		t.Errorf("unknown scope: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	if code := deleteOverREST("user3", "msg0", DeleteForMe); code != http.StatusNotFound {
+		t.Errorf("non-member: got status %v; want %v", code, http.StatusNotFound)
+	}
+
+	/////////////////////////////////////////////////
+	// deleting for everyone leaves a tombstone and tells every
+	// participant; the author heard nothing about user2's own delete
+	/////////////////////////////////////////////////
+	writeFrame(t, author, FrameDelete, "d2", DeletePayload{MessageID: "msg0", Scope: DeleteForEveryone})
+	for name, ws := range map[string]*websocket.Conn{"author": author, "phone": phone} {
+		var deletion DeletePayload
+		readFrame(t, ws, FrameDelete, &deletion)
+		if deletion.MessageID != "msg0" || deletion.ConvID != conversation.ID || deletion.Scope != DeleteForEveryone {
+			t.Errorf("%s got an unexpected delete event: %+v", name, deletion)
+		}
+	}
+	readUpdate()
+
+	messages := history("user1")
+	if len(messages) != 2 || messages[0].ID != "msg0" {
+		t.Fatalf("the tombstone is missing from history: %+v", messages)
+	}
+	if !messages[0].Deleted || messages[0].Content != "" {
+		t.Errorf("message was not tombstoned: %+v", messages[0])
+	}
+	if messages[1].Deleted || messages[1].Content != "ciphertext" {
+		t.Errorf("the wrong message was deleted: %+v", messages[1])
+	}
+
+	/////////////////////////////////////////////////
+	// a message id from a conversation the sender is not in can't be
+	// reused to delete that message
+	/////////////////////////////////////////////////
+	other := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user2": {Username: "user2"},
+			"user3": {Username: "user3"},
+		},
+	}
+	if err := testDB.CreateConversation(other); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+	secret := Message{ID: "secret", ConvID: other.ID, From: "user3", Content: "ciphertext", Timestamp: &base}
+	if err := testDB.AddMessageToConversation(secret); err != nil {
+		t.Fatalf("Failed to add message: %v", err)
+	}
+	writeFrame(t, author, FrameSend, "s1", Message{ID: "secret", ConvID: conversation.ID, Content: "mine"})
+	if env := readFrame(t, author, FrameError, &rejection); env.ID != "s1" || rejection.Code != "duplicate_id" {
+		t.Errorf("unexpected error frame: %s %+v", env.ID, rejection)
+	}
+	writeFrame(t, author, FrameDelete, "d3", DeletePayload{MessageID: "secret", Scope: DeleteForEveryone})
+	readFrame(t, author, FrameError, &rejection)
+	stored, err := testDB.GetMessage("secret")
+	if err != nil || stored.Deleted || stored.ConvID != other.ID {
+		t.Errorf("message in another conversation was touched: %+v %v", stored, err)
+	}
+}
+
+// ***********************************************
+func TestEditMessage(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conversation := Conversation{
+		ID: uuid.NewString(),
+		Participants: map[string]Participant{
+			"user1": {Username: "user1"},
+			"user2": {Username: "user2"},
+		},
+	}
+	if err := testDB.CreateConversation(conversation); err != nil {
+		t.Fatalf("Failed to insert conversation into database: %v", err)
+	}
+	timestamp := time.Now().UTC().Truncate(time.Millisecond)
+	original := Message{ID: "msg0", ConvID: conversation.ID, From: "user1", Content: "v0", Timestamp: &timestamp}
+	if err := testDB.AddMessageToConversation(original); err != nil {
+		t.Fatalf("Failed to add message: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	defer server.Close()
+
+	author := dialProtocol(t, server.URL, "user1", "laptop", protocolVersion)
+	defer author.Close()
+	other := dialProtocol(t, server.URL, "user2", "phone", protocolVersion)
+	defer other.Close()
+	waitForClients(t, "user1", "user2")
+
+	editOverREST := func(username, messageID, content string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{
+			"conversationId": conversation.ID,
+			"messageId":      messageID,
+			"content":        content,
+		})
+		request, _ := http.NewRequest("POST", "/api/edit-message", bytes.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), "username", username))
+		responseRecorder := httptest.NewRecorder()
+		HandleEditMessage(responseRecorder, request)
+		return responseRecorder
+	}
+
+	/////////////////////////////////////////////////
+	// every edit reaches every participant
+	/////////////////////////////////////////////////
+	edits := maxRevisions + 2
+	for i := 1; i <= edits; i++ {
+		content := fmt.Sprintf("v%d", i)
+		writeFrame(t, author, FrameEdit, "", EditPayload{MessageID: "msg0", Content: content})
+		for name, ws := range map[string]*websocket.Conn{"author": author, "other": other} {
+			var edit EditPayload
+			readFrame(t, ws, FrameEdit, &edit)
+			if edit.MessageID != "msg0" || edit.ConvID != conversation.ID || edit.Content != content || edit.EditedAt == nil {
+				t.Fatalf("%s got an unexpected edit event: %+v", name, edit)
+			}
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// the revision list keeps only the most recent versions
+	/////////////////////////////////////////////////
+	stored, err := testDB.GetMessage("msg0")
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if len(stored.Revisions) != maxRevisions {
+		t.Fatalf("expected %d revisions, got %d", maxRevisions, len(stored.Revisions))
+	}
+	for i, revision := range stored.Revisions {
+		if want := fmt.Sprintf("v%d", edits-maxRevisions+i); revision.Content != want || revision.Timestamp == nil {
+			t.Errorf("revision %d: got %+v want content %s", i, revision, want)
+		}
+	}
+
+	/////////////////////////////////////////////////
+	// history shows the current version and that it was edited
+	/////////////////////////////////////////////////
+	request, _ := http.NewRequest("GET", "/api/conversation?id="+conversation.ID, nil)
+	request = request.WithContext(context.WithValue(request.Context(), "username", "user2"))
+	responseRecorder := httptest.NewRecorder()
+	HandleGetUserConversation(responseRecorder, request)
+	if strings.Contains(responseRecorder.Body.String(), "Revisions") {
+		t.Errorf("history exposes revisions: %s", responseRecorder.Body)
+	}
+	var page ConversationPage
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(page.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %+v", page.Messages)
+	}
+	current := page.Messages[0]
+	if want := fmt.Sprintf("v%d", edits); current.Content != want || !current.Edited || current.EditedAt == nil {
+		t.Errorf("history does not show the edit: %+v", current)
+	}
+	if !current.Timestamp.Equal(timestamp) {
+		t.Errorf("editing moved the message: %v want %v", current.Timestamp, timestamp)
+	}
+
+	/////////////////////////////////////////////////
+	// only the author can edit, and only with content
+	/////////////////////////////////////////////////
+	if code := editOverREST("user2", "msg0", "hijacked").Code; code != http.StatusForbidden {
+		t.Errorf("non-author edit: got status %v; want %v", code, http.StatusForbidden)
+	}
+	if code := editOverREST("user1", "msg0", "").Code; code != http.StatusBadRequest {
+		t.Errorf("empty edit: got status %v; want %v", code, http.StatusBadRequest)
+	}
+	if code := editOverREST("user1", "missing", "x").Code; code != http.StatusNotFound {
+		t.Errorf("missing message: got status %v; want %v", code, http.StatusNotFound)
+	}
+	writeFrame(t, other, FrameEdit, "e1", EditPayload{MessageID: "msg0", Content: "hijacked"})
+	var rejection ErrorPayload
+	if env := readFrame(t, other, FrameError, &rejection); env.ID != "e1" || rejection.Code != "forbidden" {
+		t.Errorf("unexpected error frame: %s %+v", env.ID, rejection)
+	}
+
+	response := editOverREST("user1", "msg0", "final")
+	if response.Code != http.StatusOK {
+		t.Fatalf("edit over REST: got status %v", response.Code)
+	}
+	var edited Message
+	if err := json.NewDecoder(response.Body).Decode(&edited); err != nil || edited.Content != "final" || !edited.Edited {
+		t.Errorf("unexpected edit response: %+v %v", edited, err)
+	}
+
+	/////////////////////////////////////////////////
+	// content that looks like a field path is stored as written
+	/////////////////////////////////////////////////
+	for _, content := range []string{"$from", "$$ROOT"} {
+		if code := editOverREST("user1", "msg0", content).Code; code != http.StatusOK {
+			t.Fatalf("edit with %q: got status %v", content, code)
+		}
+		stored, err := testDB.GetMessage("msg0")
+		if err != nil || stored.Content != content {
+			t.Errorf("edit with %q: stored %+v %v", content, stored, err)
+		}
+	}
+	if _, _, err := testDB.GetMessagePage(conversation.ID, MessagePage{Limit: 10, Viewer: "user2"}); err != nil {
+		t.Errorf("history broke after a $ edit: %v", err)
+	}
+
+	/////////////////////////////////////////////////
+	// a tombstone drops its revisions and cannot be edited
+	/////////////////////////////////////////////////
+	if err := deleteMessage("user1", conversation.ID, "msg0", DeleteForEveryone); err != nil {
+		t.Fatalf("Failed to delete message: %v", err)
+	}
+	if stored, _ := testDB.GetMessage("msg0"); len(stored.Revisions) != 0 {
+		t.Errorf("tombstone kept its revisions: %+v", stored.Revisions)
+	}
+	if code := editOverREST("user1", "msg0", "resurrected").Code; code != http.StatusNotFound {
+		t.Errorf("editing a tombstone: got status %v; want %v", code, http.StatusNotFound)
+	}
+}
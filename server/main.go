@@ -3,22 +3,26 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"sync"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/joemafrici/argo/utils"
-
-	"github.com/gorilla/websocket"
 )
 
 var (
 	// userConnections []UserConnection
-	clientsMu = &sync.RWMutex{}
-	clients   = make(map[string]*websocket.Conn, 0)
-	dbname    = "argodb"
-	db        *DBClient
+	clients = NewRegistry()
+	dbname  = "argodb"
+	db      Store
+	// limiter throttles /api/login
+	limiter = NewLoginLimiter(NewMemoryAttempts())
+	// trustedProxies may set X-Real-IP, see clientIP
+	trustedProxies []*net.IPNet
+	// readLoops counts the running HandleConnection goroutines
+	readLoops sync.WaitGroup
 )
 
 const (
@@ -27,10 +31,17 @@ const (
 
 // ***********************************************
 func main() {
-	errSecret := utils.LoadSecret()
-	if errSecret != nil {
-		log.Fatal(errSecret)
+	// a keyring replaces the single secret in .env
+	if os.Getenv("JWT_KEYRING") == "" {
+		errSecret := utils.LoadSecret()
+		if errSecret != nil {
+			log.Fatal(errSecret)
+		}
 	}
+	if err := utils.LoadKeyring(); err != nil {
+		log.Fatal(err)
+	}
+	utils.CheckSession = checkSession
 
 	log.Println("connecting to database")
 	//cs := "mongodb://localhost:27017"
@@ -38,24 +49,73 @@ func main() {
 	if mongoURI == "" {
 		mongoURI = "mongodb://mongo:27017/argodb"
 	}
+	// ARGO_STORE=memory runs without MongoDB, handy for local demos
 	var err error
-	db, err = NewDBClient(mongoURI, dbname)
+	db, err = NewStore(os.Getenv("ARGO_STORE"), mongoURI, dbname)
 	if err != nil {
 		log.Fatal("Failed to connect to database", err)
 	}
 	defer db.Close()
+	if client, ok := db.(*DBClient); ok {
+		if err := client.EnsureIndexes(); err != nil {
+			log.Fatal(err)
+		}
+		if err := client.Migrate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// ARGO_ACCOUNT_DELETION=anonymize keeps a deleted account's messages
+	// under a placeholder author instead of tombstoning them
+	switch policy := os.Getenv("ARGO_ACCOUNT_DELETION"); policy {
+	case "":
+	case AccountDeletionTombstone, AccountDeletionAnonymize:
+		accountDeletionPolicy = policy
+	default:
+		log.Fatal("unknown account deletion policy: " + policy)
+	}
+	// ARGO_TRUSTED_PROXIES lists the reverse proxies, like nginx, whose
+	// X-Real-IP header is the client's address
+	trustedProxies, err = parseTrustedProxies(os.Getenv("ARGO_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// ARGO_LOGIN_LIMITER=shared keeps login failures in MongoDB so every
+	// replica sees them
+	if os.Getenv("ARGO_LOGIN_LIMITER") == "shared" {
+		client, ok := db.(*DBClient)
+		if !ok {
+			log.Fatal("the shared login limiter needs the mongo store")
+		}
+		limiter = NewLoginLimiter(client)
+	}
 
 	mux := http.NewServeMux()
 	port := "0.0.0.0:3001"
 	mux.Handle("/ws", loggingMiddleware(http.HandlerFunc(HandleWebSocket)))
 	mux.Handle("/api/register", loggingMiddleware(http.HandlerFunc(HandleRegister)))
 	mux.Handle("/api/login", loggingMiddleware(http.HandlerFunc(HandleLogin)))
-	//mux.Handle("/api/logout", loggingMiddleware(http.HandlerFunc(HandleLogout)))
+	mux.Handle("/api/recover/key", loggingMiddleware(http.HandlerFunc(HandleRecoveryKey)))
+	mux.Handle("/api/recover", loggingMiddleware(http.HandlerFunc(HandleRecover)))
+	mux.Handle("/api/recovery-key", loggingMiddleware(protectedEndpoint(HandleSetRecoveryKey)))
+	mux.Handle("/api/login/2fa", loggingMiddleware(http.HandlerFunc(HandleLoginTOTP)))
+	mux.Handle("/api/2fa/enroll", loggingMiddleware(protectedEndpoint(HandleTOTPEnroll)))
+	mux.Handle("/api/2fa/verify", loggingMiddleware(protectedEndpoint(HandleTOTPVerify)))
+	mux.Handle("/api/2fa/disable", loggingMiddleware(protectedEndpoint(HandleTOTPDisable)))
+	mux.Handle("/api/jwks", loggingMiddleware(http.HandlerFunc(HandleJWKS)))
+	mux.Handle("/api/refresh", loggingMiddleware(http.HandlerFunc(HandleRefresh)))
+	mux.Handle("/api/logout", loggingMiddleware(protectedEndpoint(HandleLogout)))
+	mux.Handle("/api/logout-all", loggingMiddleware(protectedEndpoint(HandleLogoutAll)))
+	mux.Handle("/api/change-password", loggingMiddleware(protectedEndpoint(HandleChangePassword)))
+	mux.Handle("/api/account", loggingMiddleware(protectedEndpoint(HandleDeleteAccount)))
+	mux.Handle("/api/sessions", loggingMiddleware(protectedEndpoint(HandleSessions)))
 	mux.Handle("/api/conversations", loggingMiddleware(protectedEndpoint(HandleGetUserConversations)))
 	mux.Handle("/api/conversation", loggingMiddleware(protectedEndpoint(HandleGetUserConversation)))
+	mux.Handle("/api/receipts", loggingMiddleware(protectedEndpoint(HandleGetReceipts)))
+	mux.Handle("/api/mark-read", loggingMiddleware(protectedEndpoint(HandleMarkConversationRead)))
 	mux.Handle("/api/create-conversation", loggingMiddleware(protectedEndpoint(HandleCreateConversation)))
 	mux.Handle("/api/symmetric-key", loggingMiddleware(protectedEndpoint(HandleSymmetricKey)))
 	mux.Handle("/api/delete-message", loggingMiddleware(protectedEndpoint(HandleDeleteMessage)))
+	mux.Handle("/api/edit-message", loggingMiddleware(protectedEndpoint(HandleEditMessage)))
 	mux.Handle("/api/keys", loggingMiddleware(protectedEndpoint(HandleSendKeys)))
 	mux.Handle("/api/salt", loggingMiddleware(protectedEndpoint(HandleSendSalt)))
 	handler := corsMiddleware(mux)
@@ -100,6 +160,7 @@ func protectedEndpoint(handler http.HandlerFunc) http.HandlerFunc {
 		}
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 			ctx := context.WithValue(r.Context(), "username", claims["username"])
+			ctx = context.WithValue(ctx, "sessionID", claims["jti"])
 			handler(w, r.WithContext(ctx))
 		} else {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -108,12 +169,8 @@ func protectedEndpoint(handler http.HandlerFunc) http.HandlerFunc {
 }
 
 // ***********************************************
-func closeConnection(conn *websocket.Conn) {
-	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
-	conn.WriteMessage(websocket.CloseMessage, message)
-
-	err := conn.Close()
-	if err != nil {
-		log.Println("error closing WebSocket connection", err)
-	}
+// sendError tells the client a frame was rejected. id is the id of the
+// client's frame, if it sent one, so the error can be matched to it.
+func sendError(conn *Conn, id, code, message string) {
+	conn.SendFrame(FrameError, id, ErrorPayload{Code: code, Message: message})
 }
@@ -0,0 +1,937 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps users and conversations in process.
+// It is meant for tests and local demos; nothing survives a restart.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	users         map[string]User
+	salts         map[string]string
+	conversations map[string]Conversation
+	// messages keyed by conversation id, mirroring the messages collection
+	messages map[string][]Message
+	// conversation id of every message, message ids are unique like in
+	// the messages collection
+	messageConvs map[string]string
+	// last acknowledged position of each user's devices
+	deliveryCursors map[deliveryKey]Cursor
+	sessions        map[string]Session
+	// refresh tokens keyed by hash
+	refreshTokens map[string]RefreshToken
+	// conversation ids in insertion order so listings are stable
+	order []string
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+type deliveryKey struct {
+	username string
+	device   string
+}
+
+// ***********************************************
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:           make(map[string]User),
+		salts:           make(map[string]string),
+		conversations:   make(map[string]Conversation),
+		messages:        make(map[string][]Message),
+		messageConvs:    make(map[string]string),
+		deliveryCursors: make(map[deliveryKey]Cursor),
+		sessions:        make(map[string]Session),
+		refreshTokens:   make(map[string]RefreshToken),
+	}
+}
+
+// ***********************************************
+func (m *MemoryStore) CreateSession(session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[session.ID]; ok {
+		return fmt.Errorf("session %s already exists", session.ID)
+	}
+	m.sessions[session.ID] = session
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetSession(id string) (Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return copySession(session), nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetUserSessions(username string) ([]Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]Session, 0)
+	for _, session := range m.sessions {
+		if session.Username == username && session.RevokedAt == nil {
+			sessions = append(sessions, copySession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) TouchSession(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if at.After(session.LastSeen) {
+		session.LastSeen = at
+		m.sessions[id] = session
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) RevokeSession(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if session.RevokedAt == nil {
+		session.RevokedAt = &at
+		m.sessions[id] = session
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) RevokeUserSessions(username string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.Username == username && session.RevokedAt == nil {
+			session.RevokedAt = &at
+			m.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) CreateRefreshToken(token RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.refreshTokens[token.Hash]; ok {
+		return fmt.Errorf("refresh token already exists")
+	}
+	m.refreshTokens[token.Hash] = token
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) UseRefreshToken(hash string) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[hash]
+	if !ok {
+		return RefreshToken{}, ErrNotFound
+	}
+	if token.Used {
+		return token, ErrRefreshTokenReused
+	}
+	used := token
+	used.Used = true
+	m.refreshTokens[hash] = used
+	return token, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) RevokeRefreshFamily(family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.refreshTokens {
+		if token.Family == family {
+			token.Revoked = true
+			m.refreshTokens[hash] = token
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) CreateConversation(conversation Conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.conversations[conversation.ID]; exists {
+		return fmt.Errorf("Error creating new conversation: duplicate id %s", conversation.ID)
+	}
+	conversation = copyConversation(conversation)
+	conversation.Messages = nil
+	if conversation.LastActivity == nil {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		conversation.LastActivity = &now
+	}
+	m.conversations[conversation.ID] = conversation
+	m.order = append(m.order, conversation.ID)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) AddMessageToConversation(message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation, ok := m.conversations[message.ConvID]
+	if !ok {
+		return fmt.Errorf("no conversation found with id %s", message.ConvID)
+	}
+	if _, exists := m.messageConvs[message.ID]; exists {
+		return ErrDuplicate
+	}
+	m.messages[message.ConvID] = append(m.messages[message.ConvID], copyMessage(message))
+	m.messageConvs[message.ID] = message.ConvID
+
+	summary := message.Summary()
+	conversation.LastMessage = &summary
+	if message.Timestamp != nil && (conversation.LastActivity == nil || message.Timestamp.After(*conversation.LastActivity)) {
+		timestamp := *message.Timestamp
+		conversation.LastActivity = &timestamp
+	}
+	for username, participant := range conversation.Participants {
+		if username != message.From {
+			participant.UnreadCount++
+			conversation.Participants[username] = participant
+		}
+	}
+	m.conversations[message.ConvID] = conversation
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) MarkConversationRead(convID, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation, ok := m.conversations[convID]
+	if !ok {
+		return ErrNotFound
+	}
+	participant, ok := conversation.Participants[username]
+	if !ok {
+		return ErrNotFound
+	}
+	participant.UnreadCount = 0
+	conversation.Participants[username] = participant
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetConversationSummaries(username string, page SummaryPage) ([]Conversation, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conversations := []Conversation{}
+	for _, conversation := range m.conversations {
+		if _, ok := conversation.Participants[username]; !ok {
+			continue
+		}
+		if page.Before != nil && !conversationBefore(Conversation{ID: page.Before.ID, LastActivity: &page.Before.Timestamp}, conversation) {
+			continue
+		}
+		conversations = append(conversations, copyConversation(conversation))
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversationBefore(conversations[i], conversations[j])
+	})
+
+	if len(conversations) > page.Limit {
+		return conversations[:page.Limit], true, nil
+	}
+	return conversations, false, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetConversationMessages(convID string) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sortedMessages(convID, ""), nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetMessagePage(convID string, page MessagePage) ([]Message, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := m.sortedMessages(convID, page.Viewer)
+	switch {
+	case page.After != nil:
+		start := sort.Search(len(messages), func(i int) bool {
+			return messageAfterCursor(messages[i], *page.After)
+		})
+		messages = messages[start:]
+		if len(messages) > page.Limit {
+			return messages[:page.Limit], true, nil
+		}
+		return messages, false, nil
+	case page.Before != nil:
+		end := sort.Search(len(messages), func(i int) bool {
+			return !messageBeforeCursor(messages[i], *page.Before)
+		})
+		messages = messages[:end]
+	}
+	if len(messages) > page.Limit {
+		return messages[len(messages)-page.Limit:], true, nil
+	}
+	return messages, false, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetMessage(id string) (Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	message, ok := m.findMessage(id)
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	return copyMessage(*message), nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetContacts(username string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	contacts := []string{}
+	for _, conversation := range m.conversations {
+		if _, ok := conversation.Participants[username]; !ok {
+			continue
+		}
+		for participant := range conversation.Participants {
+			if participant != username && !seen[participant] {
+				seen[participant] = true
+				contacts = append(contacts, participant)
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) HideMessage(messageID, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message, ok := m.findMessage(messageID)
+	if !ok {
+		return ErrNotFound
+	}
+	if !hiddenFor(*message, username) {
+		message.HiddenFor = append(message.HiddenFor, username)
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) TombstoneMessage(messageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message, ok := m.findMessage(messageID)
+	if !ok {
+		return ErrNotFound
+	}
+	message.Deleted = true
+	message.Content = ""
+	message.Revisions = nil
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) EditMessage(messageID, content string, at time.Time) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message, ok := m.findMessage(messageID)
+	if !ok || message.Deleted {
+		return Message{}, ErrNotFound
+	}
+	written := message.Timestamp
+	if message.EditedAt != nil {
+		written = message.EditedAt
+	}
+	message.Revisions = append(message.Revisions, Revision{Content: message.Content, Timestamp: written})
+	if len(message.Revisions) > maxRevisions {
+		message.Revisions = message.Revisions[len(message.Revisions)-maxRevisions:]
+	}
+	message.Content = content
+	message.Edited = true
+	message.EditedAt = &at
+	return copyMessage(*message), nil
+}
+
+// ***********************************************
+// findMessage returns the stored message for in place updates. Callers
+// hold m.mu.
+func (m *MemoryStore) findMessage(id string) (*Message, bool) {
+	convID, ok := m.messageConvs[id]
+	if !ok {
+		return nil, false
+	}
+	messages := m.messages[convID]
+	for i := range messages {
+		if messages[i].ID == id {
+			return &messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// ***********************************************
+func (m *MemoryStore) RecordReceipt(messageID, username, status string, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message, ok := m.findMessage(messageID)
+	if !ok {
+		return false, ErrNotFound
+	}
+	if message.Receipts == nil {
+		message.Receipts = make(map[string]Receipt)
+	}
+	receipt := message.Receipts[username]
+	changed := false
+	if receipt.Delivered == nil || at.Before(*receipt.Delivered) {
+		receipt.Delivered = &at
+		changed = true
+	}
+	if status == ReceiptRead && (receipt.Read == nil || at.Before(*receipt.Read)) {
+		receipt.Read = &at
+		changed = true
+	}
+	message.Receipts[username] = receipt
+	return changed, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetMessagesSince(username string, after Cursor, limit int) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := []Message{}
+	for id, conversation := range m.conversations {
+		if _, ok := conversation.Participants[username]; !ok {
+			continue
+		}
+		for _, message := range m.messages[id] {
+			if messageAfterCursor(message, after) && !hiddenFor(message, username) {
+				messages = append(messages, copyMessage(message))
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messageBefore(messages[i], messages[j])
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetDeliveryCursor(username, device string) (Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cursor, ok := m.deliveryCursors[deliveryKey{username, device}]
+	if !ok {
+		return Cursor{}, ErrNotFound
+	}
+	return cursor, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) AdvanceDeliveryCursor(username, device string, cursor Cursor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := deliveryKey{username, device}
+	current, ok := m.deliveryCursors[key]
+	if ok && !messageBeforeCursor(Message{ID: current.ID, Timestamp: &current.Timestamp}, cursor) {
+		return nil
+	}
+	m.deliveryCursors[key] = cursor
+	return nil
+}
+
+// ***********************************************
+// sortedMessages returns a copy of the conversation's messages ordered by
+// timestamp and then id, the same order the MongoDB store uses.
+// Callers must hold m.mu.
+func (m *MemoryStore) sortedMessages(convID, viewer string) []Message {
+	messages := make([]Message, 0, len(m.messages[convID]))
+	for _, message := range m.messages[convID] {
+		if viewer != "" && hiddenFor(message, viewer) {
+			continue
+		}
+		messages = append(messages, copyMessage(message))
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messageBefore(messages[i], messages[j])
+	})
+	return messages
+}
+
+// ***********************************************
+func (m *MemoryStore) withMessages(conversation Conversation, viewer string) Conversation {
+	conversation = copyConversation(conversation)
+	conversation.Messages = m.sortedMessages(conversation.ID, viewer)
+	return conversation
+}
+
+// ***********************************************
+func (m *MemoryStore) GetUserConversation(username string, id string) (Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conversation, ok := m.conversations[id]
+	if !ok {
+		return Conversation{}, ErrNotFound
+	}
+	if _, ok := conversation.Participants[username]; !ok {
+		return Conversation{}, ErrNotFound
+	}
+	return copyConversation(conversation), nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetUserConversations(username string) ([]Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var conversations []Conversation
+	for _, id := range m.order {
+		conversation := m.conversations[id]
+		if _, ok := conversation.Participants[username]; ok {
+			conversations = append(conversations, m.withMessages(conversation, username))
+		}
+	}
+	return conversations, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) GetAllConversations() ([]Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var conversations []Conversation
+	for _, id := range m.order {
+		conversations = append(conversations, m.withMessages(m.conversations[id], ""))
+	}
+	return conversations, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) UpdateParticipantSymmetricKey(conversationID, username, encryptedKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conversation, ok := m.conversations[conversationID]
+	if !ok {
+		return nil
+	}
+	participant, ok := conversation.Participants[username]
+	if !ok {
+		return nil
+	}
+	participant.EncryptedSymmetricKey = encryptedKey
+	conversation.Participants[username] = participant
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) StoreUserSalt(username, salt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	if !ok {
+		log.Println("Unable to find " + username + " in database")
+		return nil
+	}
+	m.salts[stored] = salt
+	log.Println("Stored salt for " + username)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) StoreUserKeys(username, publicKey, encryptedPrivateKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok {
+		log.Println("Unable to find " + username + " in database")
+		return nil
+	}
+	user.PublicKey = publicKey
+	user.EncryptedPrivateKey = encryptedPrivateKey
+	m.users[stored] = user
+	log.Println("Stored public key and encrypted private key for " + username)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) ChangePassword(username, oldHash, newHash, encryptedPrivateKey, saltBase64 string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok || user.Password != oldHash {
+		return ErrNotFound
+	}
+	user.Password = newHash
+	user.EncryptedPrivateKey = encryptedPrivateKey
+	user.SaltBase64 = saltBase64
+	m.users[stored] = user
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) CreateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// usernames are unique regardless of case, like the collation on the
+	// users index makes them
+	if _, exists := m.findUsername(user.Username); exists {
+		return ErrDuplicate
+	}
+	m.users[user.Username] = copyUser(user)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) FindUserByUsername(username string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stored, ok := m.findUsername(username)
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return copyUser(m.users[stored]), nil
+}
+
+// ***********************************************
+// findUsername returns the stored username that matches username apart
+// from case. Callers hold m.mu.
+func (m *MemoryStore) findUsername(username string) (string, bool) {
+	if _, ok := m.users[username]; ok {
+		return username, true
+	}
+	for stored := range m.users {
+		if strings.EqualFold(stored, username) {
+			return stored, true
+		}
+	}
+	return "", false
+}
+
+// ***********************************************
+func (m *MemoryStore) SetRecoveryKey(username string, key *RecoveryKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Recovery = key
+	m.users[stored] = copyUser(user)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) SetTOTP(username string, totp *TOTP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TOTP = totp
+	m.users[stored] = copyUser(user)
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) UseTOTPStep(username string, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok || user.TOTP == nil {
+		return false, ErrNotFound
+	}
+	if step <= user.TOTP.LastStep {
+		return false, nil
+	}
+	user.TOTP.LastStep = step
+	return true, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) UseRecoveryCode(username, hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	user := m.users[stored]
+	if !ok || user.TOTP == nil {
+		return false, ErrNotFound
+	}
+	for i, stored := range user.TOTP.RecoveryCodes {
+		if stored == hash {
+			user.TOTP.RecoveryCodes = append(user.TOTP.RecoveryCodes[:i], user.TOTP.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.findUsername(username)
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.users, stored)
+	delete(m.salts, stored)
+	for key := range m.deliveryCursors {
+		if key.username == username {
+			delete(m.deliveryCursors, key)
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+func (m *MemoryStore) RemoveParticipant(username string) ([]Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var left []Conversation
+	order := m.order[:0]
+	for _, id := range m.order {
+		conversation := m.conversations[id]
+		if _, ok := conversation.Participants[username]; ok {
+			delete(conversation.Participants, username)
+			left = append(left, copyConversation(conversation))
+			if len(conversation.Participants) == 0 {
+				for _, message := range m.messages[id] {
+					delete(m.messageConvs, message.ID)
+				}
+				delete(m.conversations, id)
+				delete(m.messages, id)
+				continue
+			}
+		}
+		order = append(order, id)
+	}
+	m.order = order
+	return left, nil
+}
+
+// ***********************************************
+func (m *MemoryStore) ScrubUserMessages(username, policy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for convID, messages := range m.messages {
+		for i := range messages {
+			message := &messages[i]
+			delete(message.Receipts, username)
+			hidden := message.HiddenFor[:0]
+			for _, name := range message.HiddenFor {
+				if name != username {
+					hidden = append(hidden, name)
+				}
+			}
+			message.HiddenFor = hidden
+			if message.From != username {
+				continue
+			}
+			if policy == AccountDeletionAnonymize {
+				message.From = DeletedUsername
+			} else {
+				message.Deleted = true
+				message.Content = ""
+				message.Revisions = nil
+			}
+		}
+		conversation, ok := m.conversations[convID]
+		if ok && policy == AccountDeletionAnonymize && conversation.LastMessage != nil && conversation.LastMessage.From == username {
+			last := *conversation.LastMessage
+			last.From = DeletedUsername
+			conversation.LastMessage = &last
+			m.conversations[convID] = conversation
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+func copyUser(user User) User {
+	if user.TOTP != nil {
+		totp := *user.TOTP
+		totp.RecoveryCodes = append([]string(nil), totp.RecoveryCodes...)
+		user.TOTP = &totp
+	}
+	if user.Recovery != nil {
+		recovery := *user.Recovery
+		user.Recovery = &recovery
+	}
+	return user
+}
+
+// ***********************************************
+func copyConversation(conversation Conversation) Conversation {
+	participants := make(map[string]Participant, len(conversation.Participants))
+	for username, participant := range conversation.Participants {
+		participants[username] = participant
+	}
+	conversation.Participants = participants
+	if conversation.LastMessage != nil {
+		lastMessage := *conversation.LastMessage
+		conversation.LastMessage = &lastMessage
+	}
+	if conversation.LastActivity != nil {
+		lastActivity := *conversation.LastActivity
+		conversation.LastActivity = &lastActivity
+	}
+
+	if conversation.Messages != nil {
+		messages := make([]Message, 0, len(conversation.Messages))
+		for _, message := range conversation.Messages {
+			messages = append(messages, copyMessage(message))
+		}
+		conversation.Messages = messages
+	}
+	return conversation
+}
+
+// ***********************************************
+func copyMessage(message Message) Message {
+	if message.Timestamp != nil {
+		timestamp := *message.Timestamp
+		message.Timestamp = &timestamp
+	}
+	if message.HiddenFor != nil {
+		message.HiddenFor = append([]string(nil), message.HiddenFor...)
+	}
+	if message.EditedAt != nil {
+		editedAt := *message.EditedAt
+		message.EditedAt = &editedAt
+	}
+	if message.Revisions != nil {
+		// the timestamps are shared, but nothing writes through them
+		message.Revisions = append([]Revision(nil), message.Revisions...)
+	}
+	if message.Receipts != nil {
+		receipts := make(map[string]Receipt, len(message.Receipts))
+		for username, receipt := range message.Receipts {
+			receipts[username] = copyReceipt(receipt)
+		}
+		message.Receipts = receipts
+	}
+	return message
+}
+
+// ***********************************************
+func copySession(session Session) Session {
+	if session.RevokedAt != nil {
+		revokedAt := *session.RevokedAt
+		session.RevokedAt = &revokedAt
+	}
+	return session
+}
+
+// ***********************************************
+func hiddenFor(message Message, username string) bool {
+	for _, hidden := range message.HiddenFor {
+		if hidden == username {
+			return true
+		}
+	}
+	return false
+}
+
+// ***********************************************
+func copyReceipt(receipt Receipt) Receipt {
+	if receipt.Delivered != nil {
+		delivered := *receipt.Delivered
+		receipt.Delivered = &delivered
+	}
+	if receipt.Read != nil {
+		read := *receipt.Read
+		receipt.Read = &read
+	}
+	return receipt
+}
+
+// ***********************************************
+func messageBefore(a, b Message) bool {
+	switch {
+	case a.Timestamp == nil && b.Timestamp == nil:
+		return a.ID < b.ID
+	case a.Timestamp == nil:
+		return true
+	case b.Timestamp == nil:
+		return false
+	case !a.Timestamp.Equal(*b.Timestamp):
+		return a.Timestamp.Before(*b.Timestamp)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// Cursor is a position in a list ordered by timestamp with an id
+// breaking ties. Messages are ordered by their server assigned
+// timestamp and conversation summaries by their last activity.
+type Cursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// MessagePage selects a window of a conversation's history. With no
+// cursor the newest messages are returned. Before walks back towards
+// older messages and After walks forward towards newer ones. Viewer, if
+// set, leaves out the messages that user deleted for themselves.
+type MessagePage struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+	Viewer string
+}
+
+// SummaryPage selects a window of a user's conversations, most recently
+// active first. Before continues from the last summary of a previous page.
+type SummaryPage struct {
+	Before *Cursor
+	Limit  int
+}
+
+// ***********************************************
+func (c Cursor) Encode() string {
+	raw := strconv.FormatInt(c.Timestamp.UnixMilli(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ***********************************************
+func DecodeCursor(encoded string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Cursor{}, errors.New("malformed cursor")
+	}
+	millis, id, found := strings.Cut(string(raw), ":")
+	if !found || id == "" {
+		return Cursor{}, errors.New("malformed cursor")
+	}
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return Cursor{}, errors.New("malformed cursor")
+	}
+	return Cursor{Timestamp: time.UnixMilli(ms).UTC(), ID: id}, nil
+}
+
+// ***********************************************
+func cursorForMessage(message Message) Cursor {
+	cursor := Cursor{ID: message.ID}
+	if message.Timestamp != nil {
+		cursor.Timestamp = *message.Timestamp
+	}
+	return cursor
+}
+
+// ***********************************************
+// messageAfterCursor reports whether message sorts after cursor.
+func messageAfterCursor(message Message, cursor Cursor) bool {
+	var timestamp time.Time
+	if message.Timestamp != nil {
+		timestamp = *message.Timestamp
+	}
+	if !timestamp.Equal(cursor.Timestamp) {
+		return timestamp.After(cursor.Timestamp)
+	}
+	return message.ID > cursor.ID
+}
+
+// ***********************************************
+// messageBeforeCursor reports whether message sorts before cursor.
+func messageBeforeCursor(message Message, cursor Cursor) bool {
+	var timestamp time.Time
+	if message.Timestamp != nil {
+		timestamp = *message.Timestamp
+	}
+	if !timestamp.Equal(cursor.Timestamp) {
+		return timestamp.Before(cursor.Timestamp)
+	}
+	return message.ID < cursor.ID
+}
+
+// ***********************************************
+func cursorForConversation(conversation Conversation) Cursor {
+	cursor := Cursor{ID: conversation.ID}
+	if conversation.LastActivity != nil {
+		cursor.Timestamp = *conversation.LastActivity
+	}
+	return cursor
+}
+
+// ***********************************************
+// conversationBefore reports whether a was active more recently than b,
+// which is the order summaries are listed in.
+func conversationBefore(a, b Conversation) bool {
+	ca, cb := cursorForConversation(a), cursorForConversation(b)
+	if !ca.Timestamp.Equal(cb.Timestamp) {
+		return ca.Timestamp.After(cb.Timestamp)
+	}
+	return ca.ID > cb.ID
+}
+
+// ***********************************************
+func parseLimit(query url.Values) (int, error) {
+	limit := query.Get("limit")
+	if limit == "" {
+		return defaultPageLimit, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	return min(n, maxPageLimit), nil
+}
+
+// ***********************************************
+func parseSummaryPage(query url.Values) (SummaryPage, error) {
+	limit, err := parseLimit(query)
+	if err != nil {
+		return SummaryPage{}, err
+	}
+	page := SummaryPage{Limit: limit}
+
+	if before := query.Get("before"); before != "" {
+		cursor, err := DecodeCursor(before)
+		if err != nil {
+			return SummaryPage{}, err
+		}
+		page.Before = &cursor
+	}
+	return page, nil
+}
+
+// ***********************************************
+func parseMessagePage(query url.Values) (MessagePage, error) {
+	limit, err := parseLimit(query)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	page := MessagePage{Limit: limit}
+
+	before, after := query.Get("before"), query.Get("after")
+	if before != "" && after != "" {
+		return MessagePage{}, errors.New("before and after cannot be combined")
+	}
+	if before != "" {
+		cursor, err := DecodeCursor(before)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		page.Before = &cursor
+	}
+	if after != "" {
+		cursor, err := DecodeCursor(after)
+		if err != nil {
+			return MessagePage{}, err
+		}
+		page.After = &cursor
+	}
+	return page, nil
+}
+
+// ***********************************************
+// nextCursor returns the cursor a client passes to continue in the same
+// direction, or "" when there is nothing left to fetch.
+func (page MessagePage) nextCursor(messages []Message, hasMore bool) string {
+	if !hasMore || len(messages) == 0 {
+		return ""
+	}
+	if page.After != nil {
+		return cursorForMessage(messages[len(messages)-1]).Encode()
+	}
+	return cursorForMessage(messages[0]).Encode()
+}
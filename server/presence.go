@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+)
+
+// ***********************************************
+// handlePresence lets a client mark its user away or back online.
+// Offline is the server's call, made when the last device disconnects.
+func handlePresence(conn *Conn, env Envelope) {
+	var presence PresencePayload
+	if !decodePayload(conn, env, &presence) {
+		return
+	}
+	if presence.Status != PresenceOnline && presence.Status != PresenceAway {
+		sendError(conn, env.ID, "bad_request", "unknown presence status")
+		return
+	}
+	announcePresence(conn.Username, presence.Status)
+}
+
+// ***********************************************
+// announcePresence tells everyone who shares a conversation with
+// username about its new status.
+func announcePresence(username, status string) {
+	contacts, err := db.GetContacts(username)
+	if err != nil {
+		log.Println("contacts err", err)
+		return
+	}
+	broadcast(contacts, FramePresence, "", PresencePayload{Username: username, Status: status})
+}
+
+// ***********************************************
+// sendPresenceSnapshot tells a newly connected device which of its
+// user's contacts are online.
+func sendPresenceSnapshot(conn *Conn) {
+	if conn.Version < 1 {
+		return
+	}
+	contacts, err := db.GetContacts(conn.Username)
+	if err != nil {
+		log.Println("contacts err", err)
+		return
+	}
+	for _, contact := range contacts {
+		if clients.Connected(contact) {
+			conn.SendFrame(FramePresence, "", PresencePayload{Username: contact, Status: PresenceOnline})
+		}
+	}
+}
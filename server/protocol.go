@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// protocolVersion is the newest WebSocket protocol the server speaks.
+// Version 0 is the bare Message frames clients sent before the envelope;
+// those clients only ever receive messages and errors, plus the
+// conversationUpdate they have always been sent after a deletion, which
+// they also get when someone leaves by deleting their account.
+const protocolVersion = 1
+
+const (
+	FrameSend     = "send"
+	FrameMessage  = "message"
+	FrameAck      = "ack"
+	FrameReceipt  = "receipt"
+	FrameTyping   = "typing"
+	FramePresence = "presence"
+	FrameDelete   = "delete"
+	FrameEdit     = "edit"
+	FrameLeave    = "leave"
+	FrameError    = "error"
+)
+
+type frameHandler func(conn *Conn, env Envelope)
+
+// frameHandlers routes inbound frames by type. Anything missing here is
+// answered with an unknown_type error.
+var frameHandlers = map[string]frameHandler{
+	FrameSend:     handleSend,
+	FrameAck:      handleAck,
+	FrameTyping:   handleTyping,
+	FramePresence: handlePresence,
+	FrameDelete:   handleDeleteFrame,
+	FrameEdit:     handleEditFrame,
+	FrameError:    handleClientError,
+}
+
+var errUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ***********************************************
+// decodeEnvelope parses an inbound frame. A frame with no payload and no
+// type other than "message" is a bare Message from a version 0 client
+// and becomes a send with the whole frame as its payload.
+func decodeEnvelope(p []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(p, &env); err != nil {
+		return Envelope{}, err
+	}
+	if env.V > protocolVersion {
+		return env, errUnsupportedVersion
+	}
+	if env.V == 0 && env.Payload == nil && (env.Type == "" || env.Type == FrameMessage) {
+		return Envelope{Type: FrameSend, Payload: json.RawMessage(p)}, nil
+	}
+	return env, nil
+}
+
+// ***********************************************
+func dispatchFrame(conn *Conn, p []byte) {
+	env, err := decodeEnvelope(p)
+	if err == errUnsupportedVersion {
+		sendError(conn, env.ID, "unsupported_version", err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Unmarshal", err)
+		sendError(conn, "", "bad_request", "malformed frame")
+		return
+	}
+
+	handler, ok := frameHandlers[env.Type]
+	if !ok {
+		sendError(conn, env.ID, "unknown_type", "unknown frame type "+env.Type)
+		return
+	}
+	handler(conn, env)
+}
+
+// ***********************************************
+// decodePayload unmarshals env's payload, answering with a bad_request
+// error if it does not parse.
+func decodePayload(conn *Conn, env Envelope, v interface{}) bool {
+	if env.Payload == nil || json.Unmarshal(env.Payload, v) != nil {
+		sendError(conn, env.ID, "bad_request", "malformed "+env.Type+" payload")
+		return false
+	}
+	return true
+}
+
+// ***********************************************
+// encodeFrame encodes an outbound frame for a client speaking version.
+// It returns nil for frames a version 0 client would not understand.
+func encodeFrame(version int, typ, id string, payload interface{}) ([]byte, error) {
+	if version >= 1 {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(Envelope{V: protocolVersion, Type: typ, ID: id, Payload: raw})
+	}
+
+	switch typ {
+	case FrameMessage:
+		return json.Marshal(payload)
+	case FrameError:
+		e := payload.(ErrorPayload)
+		return json.Marshal(ErrorFrame{Type: FrameError, ID: id, Code: e.Code, Message: e.Message})
+	}
+	return nil, nil
+}
+
+// ***********************************************
+// SendFrame queues a frame encoded for the connection's protocol version.
+func (c *Conn) SendFrame(typ, id string, payload interface{}) bool {
+	data, err := encodeFrame(c.Version, typ, id, payload)
+	if err != nil {
+		log.Println("Marshal", err)
+		return false
+	}
+	if data == nil {
+		return false
+	}
+	if typ == FrameMessage {
+		return c.SendMessage(id, data)
+	}
+	return c.Send(data)
+}
+
+// ***********************************************
+// broadcast sends a frame to every device of every user in usernames,
+// encoding it once per protocol version rather than once per device.
+func broadcast(usernames []string, typ, id string, payload interface{}) {
+	encoded := make(map[int][]byte)
+	for _, username := range usernames {
+		for _, deviceConn := range clients.Devices(username) {
+			data, ok := encoded[deviceConn.Version]
+			if !ok {
+				var err error
+				data, err = encodeFrame(deviceConn.Version, typ, id, payload)
+				if err != nil {
+					log.Println("Marshal", err)
+					return
+				}
+				encoded[deviceConn.Version] = data
+			}
+			if data == nil {
+				continue
+			}
+			if typ == FrameMessage {
+				deviceConn.SendMessage(id, data)
+			} else {
+				deviceConn.Send(data)
+			}
+		}
+	}
+}
+
+// ***********************************************
+// participantNames lists the conversation's participants, leaving out
+// except if it is not empty.
+func participantNames(conversation Conversation, except string) []string {
+	usernames := make([]string, 0, len(conversation.Participants))
+	for username := range conversation.Participants {
+		if username != except {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// ***********************************************
+// handleTyping relays a typing indicator to the other participants. It
+// is never stored.
+func handleTyping(conn *Conn, env Envelope) {
+	var typing TypingPayload
+	if !decodePayload(conn, env, &typing) {
+		return
+	}
+	conversation, err := authorizeConversation(conn.Username, typing.ConvID)
+	if err != nil {
+		sendError(conn, env.ID, "not_found", "conversation not found")
+		return
+	}
+	typing.Username = conn.Username
+	broadcast(participantNames(conversation, conn.Username), FrameTyping, "", typing)
+}
+
+// ***********************************************
+// handleClientError logs an error a client reports about a frame the
+// server sent it. There is nothing to answer.
+func handleClientError(conn *Conn, env Envelope) {
+	var e ErrorPayload
+	json.Unmarshal(env.Payload, &e)
+	log.Println("client error from", conn.Username, "on device", conn.DeviceID, env.ID, e.Code, e.Message)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// AttemptStore counts failed logins per key. The in-memory store is the
+// default; DBClient implements it too so replicas can share counts.
+type AttemptStore interface {
+	// AddFailure counts a failure for key at now and returns the number
+	// of failures since the count last started over. A count starts over
+	// once window has passed without a failure.
+	AddFailure(key string, now time.Time, window time.Duration) (int, error)
+	// Failures returns the current count for key and when the last
+	// failure happened.
+	Failures(key string, now time.Time, window time.Duration) (int, time.Time, error)
+	ResetFailures(key string) error
+}
+
+// limitPolicy turns a count of failures into how long the next attempt
+// has to wait: nothing for the first Free failures, then a delay that
+// doubles with every failure, then Lockout once Threshold is reached.
+type limitPolicy struct {
+	Free      int
+	Base      time.Duration
+	Threshold int
+	Lockout   time.Duration
+	// Window is how long failures are remembered
+	Window time.Duration
+}
+
+// ***********************************************
+func (p limitPolicy) delay(failures int) time.Duration {
+	if failures >= p.Threshold {
+		return p.Lockout
+	}
+	if failures < p.Free {
+		return 0
+	}
+	delay := p.Base << (failures - p.Free)
+	if delay > p.Lockout {
+		return p.Lockout
+	}
+	return delay
+}
+
+var (
+	// a username is one account, so it is locked out quickly
+	usernamePolicy = limitPolicy{Free: 5, Base: time.Second, Threshold: 10, Lockout: 15 * time.Minute, Window: time.Hour}
+	// many users can share an address, so it gets more room
+	ipPolicy = limitPolicy{Free: 20, Base: time.Second, Threshold: 100, Lockout: 15 * time.Minute, Window: time.Hour}
+)
+
+// LoginLimiter throttles logins per username and per client IP.
+type LoginLimiter struct {
+	attempts AttemptStore
+}
+
+// ***********************************************
+func NewLoginLimiter(attempts AttemptStore) *LoginLimiter {
+	return &LoginLimiter{attempts: attempts}
+}
+
+// ***********************************************
+// usernameKey is the limiter key of a username. It is normalized the way
+// lookups are, or "alice " would get its own count of failures and still
+// log in as alice.
+func usernameKey(username string) string {
+	return "user:" + normalizeUsername(username)
+}
+
+// ***********************************************
+func limiterKeys(username, ip string) map[string]limitPolicy {
+	return map[string]limitPolicy{
+		usernameKey(username): usernamePolicy,
+		"ip:" + ip:            ipPolicy,
+	}
+}
+
+// ***********************************************
+// Wait returns how long a login for username from ip has to wait. A
+// store that cannot be reached does not lock everyone out.
+func (l *LoginLimiter) Wait(username, ip string, now time.Time) time.Duration {
+	var wait time.Duration
+	for key, policy := range limiterKeys(username, ip) {
+		failures, last, err := l.attempts.Failures(key, now, policy.Window)
+		if err != nil {
+			log.Println("login limiter err", err)
+			continue
+		}
+		if until := last.Add(policy.delay(failures)); until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// ***********************************************
+// Fail records a failed login for username from ip.
+func (l *LoginLimiter) Fail(username, ip string, now time.Time) {
+	for key, policy := range limiterKeys(username, ip) {
+		failures, err := l.attempts.AddFailure(key, now, policy.Window)
+		if err != nil {
+			log.Println("login limiter err", err)
+			continue
+		}
+		if failures == policy.Threshold {
+			log.Println("locking out", key, "for", policy.Lockout)
+		}
+	}
+}
+
+// ***********************************************
+// Succeed clears the username's failures. The IP keeps its count, or
+// one valid account would let an address guess at every other one.
+func (l *LoginLimiter) Succeed(username string) {
+	if err := l.attempts.ResetFailures(usernameKey(username)); err != nil {
+		log.Println("login limiter err", err)
+	}
+}
+
+type loginAttempts struct {
+	failures int
+	last     time.Time
+}
+
+// MemoryAttempts keeps failed login counts in this process.
+type MemoryAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]loginAttempts
+}
+
+// memoryAttemptsSweep is how many keys MemoryAttempts holds before it
+// drops the ones that are past their window.
+const memoryAttemptsSweep = 10000
+
+var _ AttemptStore = (*MemoryAttempts)(nil)
+
+// ***********************************************
+func NewMemoryAttempts() *MemoryAttempts {
+	return &MemoryAttempts{attempts: make(map[string]loginAttempts)}
+}
+
+// ***********************************************
+func (m *MemoryAttempts) AddFailure(key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.attempts) >= memoryAttemptsSweep {
+		for k, a := range m.attempts {
+			if now.Sub(a.last) > window {
+				delete(m.attempts, k)
+			}
+		}
+	}
+
+	a := m.attempts[key]
+	if now.Sub(a.last) > window {
+		a.failures = 0
+	}
+	a.failures++
+	a.last = now
+	m.attempts[key] = a
+	return a.failures, nil
+}
+
+// ***********************************************
+func (m *MemoryAttempts) Failures(key string, now time.Time, window time.Duration) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok || now.Sub(a.last) > window {
+		return 0, time.Time{}, nil
+	}
+	return a.failures, a.last, nil
+}
+
+// ***********************************************
+func (m *MemoryAttempts) ResetFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+// The client can wrap its private key a second time, under a recovery
+// key it generates and shows the user once. The server keeps that copy
+// and a verifier the client derives from the recovery key, so a user
+// who forgot their password can prove they hold the recovery key, get
+// the copy back, unwrap it locally and re-wrap it under a new password.
+// The recovery key itself never reaches the server.
+
+var errInvalidRecoveryKey = errors.New("invalid recovery key")
+
+// ***********************************************
+func hashRecoveryVerifier(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// ***********************************************
+// newRecoveryKey builds the recovery key from fields validateRecoveryKey
+// accepted.
+func newRecoveryKey(encryptedPrivateKey, saltBase64, verifier string) *RecoveryKey {
+	return &RecoveryKey{
+		EncryptedPrivateKey: encryptedPrivateKey,
+		SaltBase64:          saltBase64,
+		VerifierHash:        hashRecoveryVerifier(verifier),
+	}
+}
+
+// ***********************************************
+// checkRecoveryVerifier finds the user if verifier matches their
+// recovery key. Unknown users and wrong verifiers look the same.
+func checkRecoveryVerifier(username, verifier string) (User, error) {
+	user, err := findUser(username)
+	if err == ErrNotFound {
+		return User{}, errInvalidRecoveryKey
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if user.Recovery == nil || verifier == "" {
+		return User{}, errInvalidRecoveryKey
+	}
+	hash := hashRecoveryVerifier(verifier)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(user.Recovery.VerifierHash)) != 1 {
+		return User{}, errInvalidRecoveryKey
+	}
+	return user, nil
+}
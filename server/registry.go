@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+)
+
+// Registry tracks the live WebSocket connections of every user. A user
+// may be connected from several devices at once, so connections are
+// keyed by username and then by device id.
+type Registry struct {
+	mu    sync.RWMutex
+	users map[string]map[string]*Conn
+}
+
+// ***********************************************
+func NewRegistry() *Registry {
+	return &Registry{
+		users: make(map[string]map[string]*Conn),
+	}
+}
+
+// ***********************************************
+// Add registers conn for its user's device. If the same device was
+// already connected its old connection is returned so the caller can
+// close it.
+func (r *Registry) Add(conn *Conn) *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devices, ok := r.users[conn.Username]
+	if !ok {
+		devices = make(map[string]*Conn)
+		r.users[conn.Username] = devices
+	}
+	old := devices[conn.DeviceID]
+	devices[conn.DeviceID] = conn
+	return old
+}
+
+// ***********************************************
+// Remove unregisters conn. It is a no-op if the device has since
+// reconnected with a different connection.
+func (r *Registry) Remove(conn *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	devices, ok := r.users[conn.Username]
+	if !ok || devices[conn.DeviceID] != conn {
+		return
+	}
+	delete(devices, conn.DeviceID)
+	if len(devices) == 0 {
+		delete(r.users, conn.Username)
+	}
+}
+
+// ***********************************************
+// Devices returns a snapshot of the user's connections keyed by device id.
+func (r *Registry) Devices(username string) map[string]*Conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make(map[string]*Conn, len(r.users[username]))
+	for deviceID, conn := range r.users[username] {
+		devices[deviceID] = conn
+	}
+	return devices
+}
+
+// ***********************************************
+func (r *Registry) Connected(username string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.users[username]) > 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+// lastSeenInterval is how stale a session's LastSeen may get before a
+// request updates it, so not every request is a write.
+const lastSeenInterval = time.Minute
+
+// ***********************************************
+// startSession records a login made with r.
+func startSession(username string, r *http.Request) (Session, error) {
+	now := time.Now().UTC()
+	session := Session{
+		ID:        uuid.NewString(),
+		Username:  username,
+		CreatedAt: now,
+		LastSeen:  now,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := db.CreateSession(session); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// ***********************************************
+// checkSession is what utils asks before it accepts an access token.
+func checkSession(sessionID string) error {
+	session, err := db.GetSession(sessionID)
+	if err == ErrNotFound {
+		return errSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return errSessionRevoked
+	}
+	if time.Since(session.LastSeen) > lastSeenInterval {
+		touchSession(sessionID)
+	}
+	return nil
+}
+
+// ***********************************************
+func touchSession(sessionID string) {
+	if err := db.TouchSession(sessionID, time.Now().UTC()); err != nil {
+		log.Println("touch session err", err)
+	}
+}
+
+// ***********************************************
+// listSessions returns the user's sessions, marking the ones with an open
+// WebSocket and the one the listing was requested with.
+func listSessions(username, currentID string) ([]SessionInfo, error) {
+	sessions, err := db.GetUserSessions(username)
+	if err != nil {
+		return nil, err
+	}
+	connected := make(map[string]bool)
+	for _, conn := range clients.Devices(username) {
+		connected[conn.SessionID] = true
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{
+			ID:        session.ID,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			UserAgent: session.UserAgent,
+			IP:        session.IP,
+			Connected: connected[session.ID],
+			Current:   session.ID == currentID,
+		})
+	}
+	return infos, nil
+}
+
+// ***********************************************
+// revokeSession ends one of the user's sessions: its access and refresh
+// tokens stop working and its WebSockets are closed.
+func revokeSession(username, sessionID string) error {
+	session, err := db.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	if session.Username != username {
+		return ErrNotFound
+	}
+	if err := db.RevokeSession(sessionID, time.Now().UTC()); err != nil {
+		return err
+	}
+	for _, conn := range clients.Devices(username) {
+		if conn.SessionID == sessionID {
+			log.Println("closing WebSocket of revoked session for", username, "on device", conn.DeviceID)
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+// revokeOtherSessions ends every session of the user except keep.
+func revokeOtherSessions(username, keep string) error {
+	sessions, err := db.GetUserSessions(username)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == keep {
+			continue
+		}
+		if err := revokeSession(username, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ***********************************************
+// revokeUserSessions ends every session of the user, on every device.
+func revokeUserSessions(username string) error {
+	if err := db.RevokeUserSessions(username, time.Now().UTC()); err != nil {
+		return err
+	}
+	for _, conn := range clients.Devices(username) {
+		conn.Close()
+	}
+	return nil
+}
+
+// ***********************************************
+// clientIP is the address the request came from. X-Real-IP is only
+// believed from a trusted proxy, anyone else could rotate it to dodge
+// the login limiter.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" && isTrustedProxy(host) {
+		return ip
+	}
+	return host
+}
+
+// ***********************************************
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ***********************************************
+// parseTrustedProxies reads a comma separated list of IPs and CIDRs, as
+// ARGO_TRUSTED_PROXIES holds them.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
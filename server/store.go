@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested document does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned by a Store when a write would create a second
+// document with a key that has to be unique, like a username.
+var ErrDuplicate = errors.New("already exists")
+
+// ErrRefreshTokenReused is returned by UseRefreshToken, along with the
+// token, when the token was already exchanged once.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Store is the persistence layer used by the handlers. DBClient is the
+// MongoDB implementation and MemoryStore keeps everything in process.
+type Store interface {
+	Close() error
+	CreateConversation(conversation Conversation) error
+	// AddMessageToConversation returns ErrDuplicate if a message with the
+	// same id exists in any conversation.
+	AddMessageToConversation(message Message) error
+	GetConversationMessages(convID string) ([]Message, error)
+	GetMessagePage(convID string, page MessagePage) ([]Message, bool, error)
+	GetMessage(id string) (Message, error)
+	// GetMessagesSince returns up to limit messages from all of the user's
+	// conversations that sort after the cursor, oldest first. Messages the
+	// user deleted for themselves are left out.
+	GetMessagesSince(username string, after Cursor, limit int) ([]Message, error)
+	// HideMessage deletes the message for username only.
+	HideMessage(messageID, username string) error
+	// TombstoneMessage deletes the message for everyone. The document
+	// stays, without its content or revisions, so ids and cursors
+	// remain valid.
+	TombstoneMessage(messageID string) error
+	// EditMessage replaces the message's content, keeping the old version
+	// in its revisions. Tombstones cannot be edited and give ErrNotFound.
+	EditMessage(messageID, content string, at time.Time) (Message, error)
+	// RecordReceipt marks the message delivered to, or read by, username.
+	// A read receipt implies delivery. Earlier timestamps win, and the
+	// result reports whether anything changed.
+	RecordReceipt(messageID, username, status string, at time.Time) (bool, error)
+	// GetDeliveryCursor returns how far the messages of username have
+	// reached one device. Clients that do not name their device share the
+	// cursor of device "".
+	GetDeliveryCursor(username, device string) (Cursor, error)
+	AdvanceDeliveryCursor(username, device string, cursor Cursor) error
+	// GetUserConversation returns the conversation without its messages,
+	// or ErrNotFound unless username is a participant. Use GetMessagePage
+	// to read the history.
+	GetUserConversation(username string, id string) (Conversation, error)
+	// GetUserConversations returns the user's conversations with the
+	// messages the user has not deleted for themselves.
+	GetUserConversations(username string) ([]Conversation, error)
+	GetAllConversations() ([]Conversation, error)
+	// GetContacts lists everyone who shares a conversation with username,
+	// not including username.
+	GetContacts(username string) ([]string, error)
+	// GetConversationSummaries lists the user's conversations without
+	// messages, most recently active first.
+	GetConversationSummaries(username string, page SummaryPage) ([]Conversation, bool, error)
+	MarkConversationRead(convID, username string) error
+	UpdateParticipantSymmetricKey(conversationID, username, encryptedKey string) error
+	StoreUserSalt(username, salt string) error
+	StoreUserKeys(username, publicKey, encryptedPrivateKey string) error
+	// ChangePassword replaces the password hash and the private key
+	// wrapped with it in one update, provided the hash is still oldHash.
+	// ErrNotFound means it changed in the meantime.
+	ChangePassword(username, oldHash, newHash, encryptedPrivateKey, saltBase64 string) error
+	CreateSession(session Session) error
+	GetSession(id string) (Session, error)
+	// GetUserSessions returns the user's unrevoked sessions, oldest first.
+	GetUserSessions(username string) ([]Session, error)
+	TouchSession(id string, at time.Time) error
+	RevokeSession(id string, at time.Time) error
+	RevokeUserSessions(username string, at time.Time) error
+	CreateRefreshToken(token RefreshToken) error
+	// UseRefreshToken marks the token with the given hash used and returns
+	// it as it was before.
+	UseRefreshToken(hash string) (RefreshToken, error)
+	RevokeRefreshFamily(family string) error
+	// CreateUser returns ErrDuplicate if the username is taken in any
+	// case.
+	CreateUser(user User) error
+	// FindUserByUsername ignores case, the user it returns has the
+	// username as stored.
+	FindUserByUsername(username string) (User, error)
+	// DeleteUser removes the user along with their delivery cursor.
+	DeleteUser(username string) error
+	// RemoveParticipant takes the user out of every conversation, their
+	// wrapped symmetric key with them, and returns those conversations as
+	// they are now, without messages. Conversations nobody is left in are
+	// deleted with their messages.
+	RemoveParticipant(username string) ([]Conversation, error)
+	// ScrubUserMessages applies an account deletion policy to the user's
+	// messages: tombstoned as if deleted for everyone, or kept with
+	// DeletedUsername as their author. Their receipts go either way.
+	ScrubUserMessages(username, policy string) error
+	// SetRecoveryKey replaces the user's recovery key; nil removes it.
+	SetRecoveryKey(username string, key *RecoveryKey) error
+	// SetTOTP replaces the user's second factor; nil removes it.
+	SetTOTP(username string, totp *TOTP) error
+	// UseTOTPStep records step as the user's last accepted code. It
+	// reports false if a code for step or a later one was already used.
+	UseTOTPStep(username string, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code with the given hash and
+	// reports whether it was there.
+	UseRecoveryCode(username, hash string) (bool, error)
+}
+
+// ***********************************************
+func NewStore(backend, connectionString, dbname string) (Store, error) {
+	switch backend {
+	case "", "mongo":
+		client, err := NewDBClient(connectionString, dbname)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown store backend: " + backend)
+	}
+}
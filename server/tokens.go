@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/joemafrici/argo/utils"
+)
+
+// refreshTokenTTL is how long a refresh token is good for. Each refresh
+// hands out a new one, so a client that keeps using the app stays in.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// ***********************************************
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ***********************************************
+// issueTokens creates an access token and a refresh token for the
+// session. The session id is the refresh token family.
+func issueTokens(username, sessionID string) (TokenResponse, error) {
+	accessToken, err := utils.NewTokenString(username, sessionID)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return TokenResponse{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now().UTC()
+	err = db.CreateRefreshToken(RefreshToken{
+		Hash:      hashRefreshToken(refreshToken),
+		Family:    sessionID,
+		Username:  username,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(utils.AccessTokenTTL / time.Second),
+	}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 with the parameters every authenticator app defaults to.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many steps either side of now a code may be from,
+	// for clocks that drift
+	totpSkew   = 1
+	totpIssuer = "Argo"
+
+	recoveryCodeCount = 10
+)
+
+var (
+	errInvalidCode    = errors.New("invalid two-factor code")
+	errTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	totpEncoding      = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// ***********************************************
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// ***********************************************
+// totpURI is the otpauth URI authenticator apps scan from a QR code.
+func totpURI(username, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// ***********************************************
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus), nil
+}
+
+// ***********************************************
+// matchTOTP returns the time step code is valid for, if it is valid for
+// one near now.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ***********************************************
+// newRecoveryCodes returns codes to show the user once and the hashes
+// to store in their place.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// ***********************************************
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ***********************************************
+// verifySecondFactor checks a TOTP code or, failing that, a recovery
+// code. Either one only works once.
+func verifySecondFactor(user User, code, recoveryCode string) error {
+	if user.TOTP == nil || !user.TOTP.Enabled {
+		return errTOTPNotEnabled
+	}
+
+	if code != "" {
+		step, ok := matchTOTP(user.TOTP.Secret, strings.TrimSpace(code), time.Now())
+		if !ok {
+			return errInvalidCode
+		}
+		fresh, err := db.UseTOTPStep(user.Username, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errInvalidCode
+		}
+		return nil
+	}
+
+	if recoveryCode != "" {
+		found, err := db.UseRecoveryCode(user.Username, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errInvalidCode
+		}
+		return nil
+	}
+	return errInvalidCode
+}
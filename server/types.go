@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"sort"
 	"time"
 )
 
@@ -10,6 +12,31 @@ type User struct {
 	PublicKey           string `bson:"publicKey"`
 	EncryptedPrivateKey string `bson:"encryptedPrivateKey"`
 	SaltBase64          string `bson:"saltBase64"`
+	// TOTP is set once the user starts enrolling a second factor
+	TOTP *TOTP `bson:"totp,omitempty" json:"-"`
+	// Recovery is set if the client set up a recovery key
+	Recovery *RecoveryKey `bson:"recovery,omitempty" json:"-"`
+}
+
+// RecoveryKey is a second copy of the user's private key, wrapped under
+// a key only the client knows. VerifierHash is the hash of a value the
+// client derives from that key to prove it has it.
+type RecoveryKey struct {
+	EncryptedPrivateKey string `bson:"encryptedPrivateKey"`
+	SaltBase64          string `bson:"saltBase64,omitempty"`
+	VerifierHash        string `bson:"verifierHash"`
+}
+
+// TOTP is a user's RFC 6238 second factor. Logins only ask for it once
+// it is Enabled, which takes a code proving the user's app has Secret.
+type TOTP struct {
+	Secret  string `bson:"secret"`
+	Enabled bool   `bson:"enabled"`
+	// LastStep is the time step of the last code accepted. Codes for it
+	// or an earlier step are refused, so each code works once.
+	LastStep int64 `bson:"lastStep"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
 }
 type Message struct {
 	ID        string     `bson:"id"`
@@ -18,30 +45,260 @@ type Message struct {
 	From      string     `bson:"from"`
 	Content   string     `bson:"content"`
 	Timestamp *time.Time `bson:"timestamp,omitempty"`
+	// Receipts is keyed by participant username. The author never has one.
+	Receipts map[string]Receipt `bson:"receipts,omitempty"`
+	// Deleted marks a tombstone: the author deleted the message for
+	// everyone and its content is gone
+	Deleted bool `bson:"deleted,omitempty"`
+	// HiddenFor lists the participants who deleted the message for
+	// themselves only
+	HiddenFor []string   `bson:"hiddenFor,omitempty" json:"-"`
+	Edited    bool       `bson:"edited,omitempty"`
+	EditedAt  *time.Time `bson:"editedAt,omitempty"`
+	// Revisions holds the versions an edit replaced, oldest first and
+	// at most maxRevisions of them
+	Revisions []Revision `bson:"revisions,omitempty" json:"-"`
+}
+type Revision struct {
+	Content string `bson:"content"`
+	// Timestamp is when this version was written
+	Timestamp *time.Time `bson:"timestamp,omitempty"`
+}
+type Receipt struct {
+	Delivered *time.Time `bson:"delivered,omitempty" json:"delivered,omitempty"`
+	Read      *time.Time `bson:"read,omitempty" json:"read,omitempty"`
+}
+type MessageSummary struct {
+	ID        string     `bson:"id" json:"id"`
+	From      string     `bson:"from" json:"from"`
+	Timestamp *time.Time `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
 }
 type Participant struct {
 	Username              string `bson:"username"`
 	PublicKey             string `bson:"publicKey"`
 	EncryptedSymmetricKey string `bson:"encryptedSymmetricKey"`
+	UnreadCount           int    `bson:"unreadCount"`
 }
 type Conversation struct {
 	ID           string                 `bson:"id"`
 	Participants map[string]Participant `bson:"participants"`
-	Messages     []Message              `bson:"messages"`
+	// Members is the participants' usernames, kept by DBClient so
+	// conversations can be looked up by member through an index
+	Members      []string        `bson:"members,omitempty" json:"-"`
+	Messages     []Message       `bson:"messages,omitempty"`
+	LastMessage  *MessageSummary `bson:"lastMessage,omitempty"`
+	LastActivity *time.Time      `bson:"lastActivity,omitempty"`
+}
+type ConversationSummary struct {
+	ID           string          `json:"id"`
+	Participants []string        `json:"participants"`
+	LastMessage  *MessageSummary `json:"lastMessage,omitempty"`
+	UnreadCount  int             `json:"unreadCount"`
+	LastActivity *time.Time      `json:"lastActivity,omitempty"`
+}
+type ConversationSummaryPage struct {
+	Conversations []ConversationSummary `json:"conversations"`
+	NextCursor    string                `json:"nextCursor,omitempty"`
+}
+type ConversationPage struct {
+	Conversation
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+type DeletePayload struct {
+	MessageID string `json:"messageId"`
+	ConvID    string `json:"convId,omitempty"`
+	Scope     string `json:"scope"`
+}
+
+// LeavePayload tells the rest of a conversation that Username deleted
+// their account, and what became of their messages.
+type LeavePayload struct {
+	ConvID   string `json:"convId"`
+	Username string `json:"username"`
+	Messages string `json:"messages"`
+}
+type EditPayload struct {
+	MessageID string     `json:"messageId"`
+	ConvID    string     `json:"convId,omitempty"`
+	Content   string     `json:"content"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
 }
 type DeleteMessageResponse struct {
 	Type         string       `json:"type"`
 	Conversation Conversation `json:"conversation"`
 }
+
+// Envelope wraps every WebSocket frame of protocol version 1. ID
+// correlates a client's frame with the errors it causes.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+type AckPayload struct {
+	MessageID string `json:"messageId"`
+	Status    string `json:"status,omitempty"`
+}
+type TypingPayload struct {
+	ConvID   string `json:"convId"`
+	Username string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+type PresencePayload struct {
+	Username string `json:"username,omitempty"`
+	Status   string `json:"status"`
+}
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+type ReceiptPayload struct {
+	MessageID string    `json:"messageId"`
+	ConvID    string    `json:"convId"`
+	Username  string    `json:"username"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+type MessageReceipts struct {
+	MessageID string             `json:"messageId"`
+	Receipts  map[string]Receipt `json:"receipts"`
+}
+type ReceiptPage struct {
+	Receipts   []MessageReceipts `json:"receipts"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// ErrorFrame is how errors reach clients that predate the envelope.
+type ErrorFrame struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// What happens to the messages of a deleted account.
+const (
+	AccountDeletionTombstone = "tombstone"
+	AccountDeletionAnonymize = "anonymize"
+	// DeletedUsername replaces the author of anonymized messages
+	DeletedUsername = "[deleted]"
+)
+
+// Session is one login. Its id is the jti of every access token issued
+// for it and the family of its refresh tokens.
+type Session struct {
+	ID        string     `bson:"id"`
+	Username  string     `bson:"username"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	LastSeen  time.Time  `bson:"lastSeen"`
+	UserAgent string     `bson:"userAgent,omitempty"`
+	IP        string     `bson:"ip,omitempty"`
+	RevokedAt *time.Time `bson:"revokedAt,omitempty"`
+}
+
+// SessionInfo is how a session is listed to its user.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	// Connected is true while a WebSocket of the session is open
+	Connected bool `json:"connected"`
+	// Current is the session the listing was requested with
+	Current bool `json:"current"`
+}
+
+// RefreshToken is stored by hash; the token itself is only ever known to
+// the client. Every token issued by rotating another one shares its
+// Family with the token the login issued.
+type RefreshToken struct {
+	Hash      string    `bson:"hash"`
+	Family    string    `bson:"family"`
+	Username  string    `bson:"username"`
+	IssuedAt  time.Time `bson:"issuedAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	Used      bool      `bson:"used"`
+	Revoked   bool      `bson:"revoked"`
+}
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the lifetime of Token in seconds
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// TwoFactorChallenge answers a correct password when the user has TOTP
+// enabled. The challenge token and a code finish the login.
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+	ExpiresIn         int    `json:"expiresIn"`
+}
+type RecoveryBundle struct {
+	EncryptedPrivateKey string `json:"encryptedPrivateKey"`
+	SaltBase64          string `json:"saltBase64"`
+}
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
 type LoginResponse struct {
-	Token string `json:"token"`
-	Keys  struct {
+	TokenResponse
+	Keys struct {
 		Public           string `json:"public"`
 		EncryptedPrivate string `json:"encryptedPrivate"`
 		SaltBase64       string `json:"saltBase64"`
 	} `json:"keys"`
 }
 
+// ***********************************************
+func (m Message) Summary() MessageSummary {
+	return MessageSummary{
+		ID:        m.ID,
+		From:      m.From,
+		Timestamp: m.Timestamp,
+	}
+}
+
+// ***********************************************
+// SummaryFor is the sidebar view of the conversation for one participant.
+func (c Conversation) SummaryFor(username string) ConversationSummary {
+	participants := make([]string, 0, len(c.Participants))
+	for name := range c.Participants {
+		participants = append(participants, name)
+	}
+	sort.Strings(participants)
+
+	return ConversationSummary{
+		ID:           c.ID,
+		Participants: participants,
+		LastMessage:  c.LastMessage,
+		UnreadCount:  c.Participants[username].UnreadCount,
+		LastActivity: c.LastActivity,
+	}
+}
+
 // type Keys struct {
 // 	PublicKey string `json:"publicKey"`
 // 	EncryptedPrivateKey string `json:"encryptedPrivateKey"`
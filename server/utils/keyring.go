@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Access tokens are signed by a keyring. Every token names its key in
+// the kid header; only the active key signs, while retiring keys keep
+// verifying the tokens they signed until those expire. Rotating is a
+// matter of adding a new active key, marking the old one retiring, and
+// removing it once AccessTokenTTL has passed.
+//
+// JWT_KEYRING points at a JSON file like
+//
+//	{"keys": [
+//		{"kid": "2024-06", "alg": "EdDSA", "status": "active", "privateKeyFile": "jwt-2024-06.pem"},
+//		{"kid": "2024-01", "alg": "HS256", "status": "retiring", "secret": "..."}
+//	]}
+//
+// Key files are PEM and relative to the keyring file. A retiring EdDSA or
+// ES256 key only needs its publicKeyFile. Without JWT_KEYRING the
+// keyring is the single HS256 key JWT_SECRET, under the kid "default".
+const (
+	KeyActive   = "active"
+	KeyRetiring = "retiring"
+)
+
+type keyringFile struct {
+	Keys []struct {
+		Kid            string `json:"kid"`
+		Alg            string `json:"alg"`
+		Status         string `json:"status"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"privateKeyFile"`
+		PublicKeyFile  string `json:"publicKeyFile"`
+	} `json:"keys"`
+}
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// sign is nil for keys that can only verify
+	sign   interface{}
+	verify interface{}
+}
+
+type keyring struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var (
+	keyringMu sync.RWMutex
+	keys      *keyring
+)
+
+// ***********************************************
+// LoadKeyring loads the keyring JWT_KEYRING points at, falling back to
+// JWT_SECRET.
+func LoadKeyring() error {
+	path := os.Getenv("JWT_KEYRING")
+	if path != "" {
+		return LoadKeyringFile(path)
+	}
+
+	secret, err := getJWTSecret()
+	if err != nil {
+		return err
+	}
+	key := &signingKey{
+		kid:    "default",
+		method: jwt.SigningMethodHS256,
+		sign:   []byte(secret),
+		verify: []byte(secret),
+	}
+	setKeyring(&keyring{active: key, keys: map[string]*signingKey{key.kid: key}})
+	return nil
+}
+
+// ***********************************************
+func LoadKeyringFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing keyring %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	readPEM := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	ring := &keyring{keys: make(map[string]*signingKey)}
+	for _, k := range file.Keys {
+		if k.Kid == "" {
+			return errors.New("keyring: key without a kid")
+		}
+		if _, ok := ring.keys[k.Kid]; ok {
+			return fmt.Errorf("keyring: duplicate kid %s", k.Kid)
+		}
+		if k.Status != KeyActive && k.Status != KeyRetiring {
+			return fmt.Errorf("keyring: key %s has unknown status %q", k.Kid, k.Status)
+		}
+
+		key := &signingKey{kid: k.Kid}
+		switch k.Alg {
+		case "HS256":
+			if k.Secret == "" {
+				return fmt.Errorf("keyring: key %s has no secret", k.Kid)
+			}
+			key.method = jwt.SigningMethodHS256
+			key.sign = []byte(k.Secret)
+			key.verify = []byte(k.Secret)
+		case "EdDSA", "ES256":
+			if err := loadAsymmetricKey(key, k.Alg, k.PrivateKeyFile, k.PublicKeyFile, readPEM); err != nil {
+				return fmt.Errorf("keyring: key %s: %w", k.Kid, err)
+			}
+		default:
+			return fmt.Errorf("keyring: key %s has unsupported alg %q", k.Kid, k.Alg)
+		}
+
+		if k.Status == KeyActive {
+			if ring.active != nil {
+				return errors.New("keyring: more than one active key")
+			}
+			if key.sign == nil {
+				return fmt.Errorf("keyring: active key %s has no private key", k.Kid)
+			}
+			ring.active = key
+		}
+		ring.keys[k.Kid] = key
+	}
+	if ring.active == nil {
+		return errors.New("keyring: no active key")
+	}
+
+	setKeyring(ring)
+	return nil
+}
+
+// ***********************************************
+func loadAsymmetricKey(key *signingKey, alg, privateFile, publicFile string, readPEM func(string) ([]byte, error)) error {
+	if privateFile != "" {
+		data, err := readPEM(privateFile)
+		if err != nil {
+			return err
+		}
+		var private crypto.Signer
+		if alg == "EdDSA" {
+			key.method = jwt.SigningMethodEdDSA
+			parsed, err := jwt.ParseEdPrivateKeyFromPEM(data)
+			if err != nil {
+				return err
+			}
+			private, _ = parsed.(crypto.Signer)
+		} else {
+			key.method = jwt.SigningMethodES256
+			parsed, err := jwt.ParseECPrivateKeyFromPEM(data)
+			if err != nil {
+				return err
+			}
+			if parsed.Curve != elliptic.P256() {
+				return errors.New("ES256 needs a P-256 key")
+			}
+			private = parsed
+		}
+		if private == nil {
+			return errors.New("unusable private key")
+		}
+		key.sign = private
+		key.verify = private.Public()
+		return nil
+	}
+
+	if publicFile == "" {
+		return errors.New("no private or public key file")
+	}
+	data, err := readPEM(publicFile)
+	if err != nil {
+		return err
+	}
+	if alg == "EdDSA" {
+		key.method = jwt.SigningMethodEdDSA
+		key.verify, err = jwt.ParseEdPublicKeyFromPEM(data)
+		return err
+	}
+	key.method = jwt.SigningMethodES256
+	public, err := jwt.ParseECPublicKeyFromPEM(data)
+	if err != nil {
+		return err
+	}
+	if public.Curve != elliptic.P256() {
+		return errors.New("ES256 needs a P-256 key")
+	}
+	key.verify = public
+	return nil
+}
+
+// ***********************************************
+func setKeyring(ring *keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keys = ring
+}
+
+// ***********************************************
+func currentKeyring() (*keyring, error) {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	if keys == nil {
+		return nil, errors.New("signing keys are not loaded")
+	}
+	return keys, nil
+}
+
+// ***********************************************
+// lookup finds the key a token names. The token's alg has to be the
+// key's, so an HS256 token can never be checked against a public key.
+func (k *keyring) lookup(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return key.verify, nil
+}
+
+// ***********************************************
+// signToken signs the token with the active key.
+func signToken(claims jwt.MapClaims) (string, error) {
+	ring, err := currentKeyring()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(ring.active.method, claims)
+	token.Header["kid"] = ring.active.kid
+	return token.SignedString(ring.active.sign)
+}
+
+// ***********************************************
+// PublicJWKS returns the public half of every asymmetric key in the
+// keyring as a JSON Web Key Set, for services that verify tokens
+// without being able to sign them.
+func PublicJWKS() (map[string]interface{}, error) {
+	ring, err := currentKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	kids := make([]string, 0, len(ring.keys))
+	for kid := range ring.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := make([]map[string]string, 0)
+	for _, kid := range kids {
+		key := ring.keys[kid]
+		jwk := map[string]string{"kid": key.kid, "alg": key.method.Alg(), "use": "sig"}
+		switch public := key.verify.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		case *ecdsa.PublicKey:
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+		default:
+			// shared secrets are never published
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return map[string]interface{}{"keys": jwks}, nil
+}
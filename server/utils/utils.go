@@ -3,7 +3,6 @@ package utils
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -33,17 +32,22 @@ func HandleDatabaseError(err error) {
 		}
 	} else if errors.As(err, &commandErr) {
 		log.Println("MongoDB command error", commandErr)
+	} else if IsDuplicateKeyError(err) {
+		log.Println("Duplicate key error:", err)
 	} else if errors.As(err, &writeException) {
-		for _, writeErr := range writeException.WriteErrors {
-			if mongo.IsDuplicateKeyError(writeErr) {
-				log.Println("Duplicate key error:", writeErr)
-			}
-		}
+		log.Println("MongoDB write error", writeException)
 	} else {
 		log.Println("mongodb error:", err)
 	}
 }
 
+// ***********************************************
+// IsDuplicateKeyError reports whether err is MongoDB refusing a write
+// because of a unique index.
+func IsDuplicateKeyError(err error) bool {
+	return err != nil && mongo.IsDuplicateKeyError(err)
+}
+
 // ***********************************************
 func EnableCORS(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*") // Adjust in production
@@ -52,35 +56,39 @@ func EnableCORS(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
 }
 
+// CheckSession, when set, reports whether the session an access token
+// was issued for is still live. main points it at the sessions store.
+var CheckSession func(sessionID string) error
+
 // ***********************************************
+// ValidateTokenFromString returns the username of a valid access token.
 func ValidateTokenFromString(tokenString string) (string, error) {
-	jwtSecret, err := getJWTSecret()
-	if err != nil {
-		return "", errors.New("unable to retrieve secret")
-	}
-
-	secretKey := []byte(jwtSecret)
-
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return secretKey, nil
-	})
+	username, _, err := ValidateSessionToken(tokenString)
+	return username, err
+}
 
+// ***********************************************
+// ValidateSessionToken returns the username and the session (the jti) of
+// a valid access token whose session has not been revoked.
+func ValidateSessionToken(tokenString string) (string, string, error) {
+	token, err := parseToken(tokenString)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		username, ok := claims["username"].(string)
 		if !ok {
-			return "", errors.New("username not found in token")
+			return "", "", errors.New("username not found in token")
 		}
-		return username, nil
+		sessionID, err := checkSessionClaim(claims)
+		if err != nil {
+			return "", "", err
+		}
+		return username, sessionID, nil
 	}
 
-	return "", errors.New("invalid token")
+	return "", "", errors.New("invalid token")
 }
 
 // ***********************************************
@@ -98,35 +106,94 @@ func ValidateToken(r *http.Request) (*jwt.Token, error) {
 		return nil, errors.New("bearer token not found")
 	}
 
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			log.Println("method check no good... returning")
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	token, err := parseToken(tokenString)
+	if err != nil {
+		return token, err
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		if _, err := checkSessionClaim(claims); err != nil {
+			return nil, err
 		}
-		secret, err := getJWTSecret()
-		if err != nil {
-			return nil, errors.New("unable to retrieve secret")
+	}
+	return token, nil
+}
+
+// ***********************************************
+func parseToken(tokenString string) (*jwt.Token, error) {
+	ring, err := currentKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.Parse(tokenString, ring.lookup)
+}
+
+// ***********************************************
+// checkSessionClaim returns the token's session id once CheckSession
+// has confirmed the session is still live.
+func checkSessionClaim(claims jwt.MapClaims) (string, error) {
+	if _, ok := claims["purpose"]; ok {
+		return "", errors.New("not an access token")
+	}
+	sessionID, ok := claims["jti"].(string)
+	if !ok || sessionID == "" {
+		return "", errors.New("session not found in token")
+	}
+	if CheckSession != nil {
+		if err := CheckSession(sessionID); err != nil {
+			return "", err
 		}
-		return []byte(secret), nil
-	})
+	}
+	return sessionID, nil
+}
 
-	return token, err
+// AccessTokenTTL is how long an access token is good for. Clients
+// get a new one from /api/refresh before it runs out.
+const AccessTokenTTL = 15 * time.Minute
 
+// ***********************************************
+// NewTokenString issues an access token for the user's session. The
+// session id goes in the jti claim so the token dies with the session.
+func NewTokenString(username, sessionID string) (string, error) {
+	return signToken(jwt.MapClaims{
+		"username": username,
+		"jti":      sessionID,
+		"exp":      time.Now().Add(AccessTokenTTL).Unix(),
+	})
 }
 
+// ChallengeTokenTTL is how long a user has to enter their second factor
+// after their password.
+const ChallengeTokenTTL = 5 * time.Minute
+
+const challengePurpose = "2fa"
+
 // ***********************************************
-func NewTokenString(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// NewChallengeToken issues the token that stands in for a correct
+// password until the second factor is checked. It is not an access token.
+func NewChallengeToken(username string) (string, error) {
+	return signToken(jwt.MapClaims{
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
+		"purpose":  challengePurpose,
+		"exp":      time.Now().Add(ChallengeTokenTTL).Unix(),
 	})
+}
 
-	secret, err := getJWTSecret()
+// ***********************************************
+// ValidateChallengeToken returns the username of a valid challenge token.
+func ValidateChallengeToken(tokenString string) (string, error) {
+	token, err := parseToken(tokenString)
 	if err != nil {
-		log.Fatal(err.Error())
+		return "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["purpose"] != challengePurpose {
+		return "", errors.New("invalid challenge token")
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		return "", errors.New("username not found in token")
 	}
-	tokenString, err := token.SignedString([]byte(secret))
-	return tokenString, err
+	return username, nil
 }
 
 // ***********************************************
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Usernames end up in MongoDB field paths (participants.<username>), so
+// they are held to a small ASCII alphabet that has no '.' or '$' in it.
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 10
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordBytes = 72
+	// minPasswordChars is how many different characters a password needs
+	minPasswordChars = 4
+	// AES-GCM output is at least its 12 byte IV and 16 byte tag
+	minWrappedKeyBytes = 28
+	minSaltBytes       = 16
+)
+
+// FieldError is one problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is every problem found with a request. It is sent as
+// a 400 so clients can point at the fields.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// ***********************************************
+func (v *ValidationError) Error() string {
+	messages := make([]string, len(v.Fields))
+	for i, field := range v.Fields {
+		messages[i] = field.Field + ": " + field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ***********************************************
+func (v *ValidationError) add(field, code, message string) {
+	v.Fields = append(v.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// ***********************************************
+// err returns v if anything was added to it.
+func (v *ValidationError) err() error {
+	if len(v.Fields) == 0 {
+		return nil
+	}
+	return v
+}
+
+// ***********************************************
+// writeDecodeError sends a body that is not the JSON a handler expects
+// as a validation error, so every 400 has the same shape.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var v ValidationError
+	v.add("body", "invalid_json", err.Error())
+	writeValidationError(w, &v)
+}
+
+// ***********************************************
+func writeValidationError(w http.ResponseWriter, err *ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error  string       `json:"error"`
+		Fields []FieldError `json:"fields"`
+	}{Error: "validation_failed", Fields: err.Fields})
+}
+
+// ***********************************************
+// normalizeUsername is the form a username is stored and looked up in.
+// Usernames are case-insensitive, so "Alice" and "alice" are one user.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// ***********************************************
+// validateUsername checks a normalized username.
+func validateUsername(v *ValidationError, username string) {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		v.add("username", "length", "must be 3 to 32 characters")
+		return
+	}
+	for i, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '_' || c == '-') && i > 0:
+		default:
+			v.add("username", "charset", "may only use letters, digits, '_' and '-', and must start with a letter or digit")
+			return
+		}
+	}
+	if username == DeletedUsername {
+		v.add("username", "reserved", "is reserved")
+	}
+}
+
+// ***********************************************
+// validatePassword holds new passwords to a minimum strength. Length
+// matters more than character classes, so that is most of it.
+func validatePassword(v *ValidationError, field, password, username string) {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		v.add(field, "too_short", "must be at least 10 characters")
+		return
+	}
+	if len(password) > maxPasswordBytes {
+		v.add(field, "too_long", "must be at most 72 bytes")
+		return
+	}
+	distinct := make(map[rune]bool)
+	for _, c := range password {
+		distinct[c] = true
+	}
+	if len(distinct) < minPasswordChars {
+		v.add(field, "too_simple", "needs more different characters")
+		return
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), username) {
+		v.add(field, "contains_username", "must not contain the username")
+	}
+}
+
+// ***********************************************
+// validatePublicKey accepts a base64 SPKI public key, as the clients
+// export it, or a JWK.
+func validatePublicKey(v *ValidationError, field, key string) {
+	if strings.HasPrefix(strings.TrimSpace(key), "{") {
+		var jwk struct {
+			Kty string `json:"kty"`
+		}
+		if json.Unmarshal([]byte(key), &jwk) != nil || jwk.Kty == "" {
+			v.add(field, "invalid_jwk", "is not a JWK")
+		}
+		return
+	}
+	der, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		v.add(field, "invalid_base64", "is not base64")
+		return
+	}
+	if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+		v.add(field, "invalid_key", "is not an SPKI public key")
+	}
+}
+
+// ***********************************************
+// validateBase64 checks a base64 field decodes to at least min bytes.
+func validateBase64(v *ValidationError, field, value string, min int) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		v.add(field, "invalid_base64", "is not base64")
+		return
+	}
+	if len(decoded) < min {
+		v.add(field, "too_short", "is too short")
+	}
+}
+
+// ***********************************************
+// validateWrappedKey checks a private key wrapped by the client, and the
+// salt of the key it was wrapped with.
+func validateWrappedKey(v *ValidationError, keyField, encryptedPrivateKey, saltField, saltBase64 string) {
+	validateBase64(v, keyField, encryptedPrivateKey, minWrappedKeyBytes)
+	validateBase64(v, saltField, saltBase64, minSaltBytes)
+}
+
+// ***********************************************
+// validateRecoveryKey checks the fields that set up a recovery key. The
+// salt is optional, a recovery key can be used as the wrapping key as is.
+func validateRecoveryKey(v *ValidationError, keyField, encryptedPrivateKey, saltField, saltBase64, verifierField, verifier string) {
+	validateBase64(v, keyField, encryptedPrivateKey, minWrappedKeyBytes)
+	if saltBase64 != "" {
+		validateBase64(v, saltField, saltBase64, minSaltBytes)
+	}
+	if verifier == "" {
+		v.add(verifierField, "required", "is required")
+	}
+}
+
+// registration is the body of /api/register. The recovery key is
+// optional.
+type registration struct {
+	Username                    string `json:"username"`
+	Password                    string `json:"password"`
+	PublicKey                   string `json:"publicKey"`
+	SaltBase64                  string `json:"saltBase64"`
+	EncryptedPrivateKey         string `json:"encryptedPrivateKey"`
+	RecoveryEncryptedPrivateKey string `json:"recoveryEncryptedPrivateKey"`
+	RecoverySaltBase64          string `json:"recoverySaltBase64"`
+	RecoveryVerifier            string `json:"recoveryVerifier"`
+}
+
+// ***********************************************
+// validate checks everything a new account is made of. The username
+// has to be normalized first.
+func (reg registration) validate() *ValidationError {
+	var v ValidationError
+	validateUsername(&v, reg.Username)
+	validatePassword(&v, "password", reg.Password, reg.Username)
+	validatePublicKey(&v, "publicKey", reg.PublicKey)
+	validateWrappedKey(&v, "encryptedPrivateKey", reg.EncryptedPrivateKey, "saltBase64", reg.SaltBase64)
+	if reg.RecoveryEncryptedPrivateKey != "" || reg.RecoverySaltBase64 != "" || reg.RecoveryVerifier != "" {
+		validateRecoveryKey(&v,
+			"recoveryEncryptedPrivateKey", reg.RecoveryEncryptedPrivateKey,
+			"recoverySaltBase64", reg.RecoverySaltBase64,
+			"recoveryVerifier", reg.RecoveryVerifier)
+	}
+	if v.err() == nil {
+		return nil
+	}
+	return &v
+}
+
+// ***********************************************
+// findUser looks a user up by a username as typed. Lookups ignore case,
+// so accounts made before usernames were normalized are found under
+// their stored name.
+func findUser(username string) (User, error) {
+	return db.FindUserByUsername(normalizeUsername(username))
+}